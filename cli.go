@@ -43,8 +43,17 @@ Options:
 	}
 
 	fs.BoolVar(&g.autoImport, "autoimport", false, "formats and adjusts imports automatically")
-	fs.StringVar(&g.extFiles, "context", "", "import packages, functions, variables and constants from external golang source files")
-	fs.StringVar(&g.packageName, "pkg", "", "the package where the session will be run inside")
+	fs.BoolVar(&g.persist, "persist", false, "keep variables between inputs instead of running all the statements again")
+	fs.BoolVar(&g.unwrap, "unwrap", false, "print and bind the values of (value, error) results, reporting non-nil errors")
+	fs.DurationVar(&g.timeout, "timeout", 0, "abort evaluations running longer than the duration")
+	fs.DurationVar(&g.wait, "wait", 0, "wait up to the duration for goroutines started by the inputs to finish")
+	fs.StringVar(&g.limits, "limits", "", "resource limits of evaluations, e.g. mem=512M,cpu=10s,files=256,procs=64")
+	fs.StringVar(&g.lang, "lang", "", "the language version of the session, e.g. go1.21 (default: the version of the go command)")
+	fs.BoolVar(&g.module, "module", true, "run the session inside the module or go.work workspace of the current directory")
+	fs.StringVar(&g.sessionFile, "session", "", "load a session saved by :save")
+	fs.StringVar(&g.extFiles, "context", "", "import packages, functions, variables and constants from external golang source files, or import packages from directories and import paths; re-included when they change")
+	fs.StringVar(&g.at, "at", "", "evaluate inside the function at <file>:<line>, with its locals before the line")
+	fs.StringVar(&g.packageName, "pkg", "", "the package (import path or directory) which the session is evaluated in, with access to its unexported identifiers")
 
 	var showVersion bool
 	fs.BoolVar(&showVersion, "version", false, "print gore version")
@@ -0,0 +1,92 @@
+package gore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Registered commands
+//
+// The programs embedding gore can add their own commands to a session by
+// RegisterCommand, like :fixture loading test data, which are invoked,
+// completed and listed by :help as the built-in ones. The commands of a
+// session do not affect other sessions. A registered command cannot take
+// the name of a command the session has; the built-in commands are matched
+// first, so an abbreviation shared with them invokes the built-in one.
+
+// Command is a command registered to a session.
+type Command struct {
+	// Name is the name of the command without the colon, whose optional
+	// part at the end is in brackets: "f[ixture]" is invoked by :f, :fi,
+	// ... and :fixture.
+	Name string
+	// Action is called with the argument of the command, the rest of the
+	// input after the name, trimmed. It writes its output to the writers
+	// of the session (see Stdout and Stderr).
+	Action func(s *Session, arg string) error
+	// Complete returns the completions of arg, the argument being entered;
+	// it may be nil.
+	Complete func(s *Session, arg string) []string
+	// Arg is the syntax of the argument shown by :help, like "<name>".
+	Arg string
+	// Help is the description shown by :help.
+	Help string
+}
+
+// RegisterCommand adds cmd to the commands of the session.
+func (s *Session) RegisterCommand(cmd Command) error {
+	name := commandName(cmd.Name)
+	if !name.valid() {
+		return fmt.Errorf("invalid command name: %q", cmd.Name)
+	}
+	if cmd.Action == nil {
+		return fmt.Errorf("command %s: no action", name)
+	}
+	for _, command := range s.allCommands() {
+		if command.name.matches(name.String()) || name.matches(command.name.String()) {
+			return fmt.Errorf("command %s: conflicts with :%s", name, command.name)
+		}
+	}
+
+	s.extraCommands = append(s.extraCommands, command{
+		name:     name,
+		action:   cmd.Action,
+		complete: cmd.Complete,
+		arg:      cmd.Arg,
+		document: cmd.Help,
+	})
+	return nil
+}
+
+// allCommands returns the built-in commands followed by
+// those registered to the session.
+func (s *Session) allCommands() []command {
+	if len(s.extraCommands) == 0 {
+		return commands
+	}
+	return append(append([]command{}, commands...), s.extraCommands...)
+}
+
+// Stdout returns the writer of the session for the standard output.
+func (s *Session) Stdout() io.Writer {
+	return s.stdout
+}
+
+// Stderr returns the writer of the session for the standard error.
+func (s *Session) Stderr() io.Writer {
+	return s.stderr
+}
+
+// valid reports whether s is a name of a command: a word optionally
+// ending with its optional part in brackets.
+func (s commandName) valid() bool {
+	name := string(s)
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		if i == 0 || !strings.HasSuffix(name, "]") || len(name) == i+2 {
+			return false
+		}
+		name = name[:i] + name[i+1:len(name)-1]
+	}
+	return name != "" && !strings.ContainsAny(name, "[]:") && len(strings.Fields(name)) == 1 && strings.TrimSpace(name) == name
+}
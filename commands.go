@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -27,6 +28,8 @@ type command struct {
 	complete func(*Session, string) []string
 	arg      string
 	document string
+	record   bool // recorded in the session inputs (see :save)
+	undoable bool // changes the code, which can be undone by :undo
 }
 
 var commands []command
@@ -39,6 +42,8 @@ func init() {
 			complete: completeImport,
 			arg:      "<package>",
 			document: "import a package",
+			record:   true,
+			undoable: true,
 		},
 		{
 			name:     commandName("t[ype]"),
@@ -63,6 +68,7 @@ func init() {
 			name:     commandName("clear"),
 			action:   actionClear,
 			document: "clear the code",
+			undoable: true,
 		},
 		{
 			name:     commandName("d[oc]"),
@@ -86,6 +92,7 @@ func init() {
 			action:   actionEdit,
 			arg:      "[cmd]",
 			document: "edit the current source",
+			undoable: true,
 		},
 		{
 			name:     commandName("r[un]"),
@@ -97,6 +104,104 @@ func init() {
 			action:   actionDefine,
 			arg:      "<declaration>",
 			document: "define (declare) a GenDecl",
+			record:   true,
+			undoable: true,
+		},
+		{
+			name:     commandName("replay"),
+			action:   actionReplay,
+			arg:      "[on|off]",
+			document: "show the output of all inputs on every run",
+		},
+		{
+			name:     commandName("timeout"),
+			action:   actionTimeout,
+			arg:      "[<duration>|off]",
+			document: "abort evaluations running longer than the duration",
+		},
+		{
+			name:     commandName("limits"),
+			action:   actionLimits,
+			arg:      "[mem=<size>,cpu=<duration>,files=<n>,procs=<n>|off]",
+			document: "show or set resource limits of evaluations",
+		},
+		{
+			name:     commandName("save"),
+			action:   actionSave,
+			arg:      "[<file>]",
+			document: "save the session",
+		},
+		{
+			name:     commandName("load"),
+			action:   actionLoad,
+			arg:      "<file>",
+			document: "load a session saved by :save, or include a .go file or a package directory like -context",
+			undoable: true,
+		},
+		{
+			name:     commandName("reload"),
+			action:   actionReload,
+			document: "re-include the files and packages of -context, :load and -pkg",
+		},
+		{
+			name:     commandName("l[ist]"),
+			action:   actionList,
+			document: "list the inputs in the code",
+		},
+		{
+			name:     commandName("rm"),
+			action:   actionRm,
+			arg:      "[-f] <n|name>",
+			document: "remove an input from the code",
+			undoable: true,
+		},
+		{
+			name:     commandName("vars"),
+			action:   actionVars,
+			document: "list the variables with their types",
+		},
+		{
+			name:     commandName("decls"),
+			action:   actionDecls,
+			document: "list the functions, types and constants",
+		},
+		{
+			name:     commandName("enter"),
+			action:   actionEnter,
+			arg:      "<file>:<line> | <func>[(<args>)]",
+			document: "evaluate inside a function, with its locals before the line",
+			record:   true,
+		},
+		{
+			name:     commandName("get"),
+			action:   actionGet,
+			arg:      "<module>[@<version>]",
+			document: "add a module requirement",
+			record:   true,
+		},
+		{
+			name:     commandName("mod"),
+			action:   actionMod,
+			document: "show the module requirements",
+		},
+		{
+			name:     commandName("set"),
+			action:   actionSet,
+			complete: completeSet,
+			arg:      "[<option> [<value>]]",
+			document: "show or set options of the session",
+		},
+		{
+			name:     commandName("undo"),
+			action:   actionUndo,
+			arg:      "[<n>]",
+			document: "undo the last n changes of the code",
+		},
+		{
+			name:     commandName("redo"),
+			action:   actionRedo,
+			arg:      "[<n>]",
+			document: "redo the last n changes undone",
 		},
 	}
 }
@@ -127,7 +232,10 @@ func actionImport(s *Session, arg string) error {
 		return err
 	}
 
-	astutil.AddImport(s.fset, s.file, path)
+	added := astutil.AddImport(s.fset, s.file, path)
+	if _, ok := s.declInputs[strconv.Quote(path)]; added || !ok {
+		s.declInputs[strconv.Quote(path)] = s.inputNo
+	}
 
 	return nil
 }
@@ -146,14 +254,14 @@ func completeImport(s *Session, prefix string) []string {
 
 		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
 			if err != nil && !os.IsNotExist(err) {
-				errorf("Stat %s: %s", dir, err)
+				s.errorf("Stat %s: %s", dir, err)
 			}
 			continue
 		}
 
 		entries, err := ioutil.ReadDir(dir)
 		if err != nil {
-			errorf("ReadDir %s: %s", dir, err)
+			s.errorf("ReadDir %s: %s", dir, err)
 			continue
 		}
 		for _, fi := range entries {
@@ -199,7 +307,7 @@ func completeImport(s *Session, prefix string) []string {
 func completeDoc(s *Session, prefix string) []string {
 	pos, cands, err := s.completeCode(prefix, len(prefix), false)
 	if err != nil {
-		errorf("completeCode: %s", err)
+		s.errorf("completeCode: %s", err)
 		return nil
 	}
 
@@ -212,12 +320,12 @@ func completeDoc(s *Session, prefix string) []string {
 }
 
 func actionPrint(s *Session, _ string) error {
-	source, err := s.source(true)
+	source, err := s.userSource(true)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(source)
+	fmt.Fprintln(s.stdout, source)
 
 	return nil
 }
@@ -243,7 +351,7 @@ func actionType(s *Session, in string) error {
 		Defs:   make(map[*ast.Ident]types.Object),
 		Scopes: make(map[ast.Node]*types.Scope),
 	}
-	_, err = s.types.Check("_tmp", s.fset, []*ast.File{s.file}, &s.typeInfo)
+	pkg, err := s.types.Check("_tmp", s.fset, []*ast.File{s.file}, &s.typeInfo)
 	if err != nil {
 		debugf("typecheck error (ignored): %s", err)
 	}
@@ -255,12 +363,13 @@ func actionType(s *Session, in string) error {
 	if typ, ok := typ.(*types.Basic); ok && typ.Kind() == types.Invalid {
 		return fmt.Errorf("cannot get type: %v", expr)
 	}
-	fmt.Fprintf(s.stdout, "%v\n", typ)
+	// types of the session are shown unqualified, e.g. "Pair[string, int]"
+	fmt.Fprintf(s.stdout, "%s\n", types.TypeString(typ, types.RelativeTo(pkg)))
 	return nil
 }
 
 func actionWrite(s *Session, filename string) error {
-	source, err := s.source(false)
+	source, err := s.userSource(false)
 	if err != nil {
 		return err
 	}
@@ -274,7 +383,7 @@ func actionWrite(s *Session, filename string) error {
 		return err
 	}
 
-	infof("Source wrote to %s", filename)
+	s.infof("Source wrote to %s", filename)
 
 	return nil
 }
@@ -396,7 +505,7 @@ func actionDoc(s *Session, in string) error {
 
 func actionHelp(s *Session, _ string) error {
 	w := tabwriter.NewWriter(s.stdout, 0, 8, 4, ' ', 0)
-	for _, command := range commands {
+	for _, command := range s.allCommands() {
 		cmd := fmt.Sprintf(":%s", command.name)
 		if command.arg != "" {
 			cmd = cmd + " " + command.arg
@@ -479,13 +588,247 @@ func actionEdit(s *Session, arg string) error {
 	s.lastStmts = nil
 	s.lastDecls = nil
 
-	return s.Run()
+	s.statePath = ""
+	s.edited = true
+
+	return s.run(true)
 }
 
 func actionRun(s *Session, _ string) error {
-	return s.Run()
+	return s.run(true)
 }
 
 func actionDefine(s *Session, in string) error {
 	return s.evalGenDecl(in)
 }
+
+func actionReplay(s *Session, arg string) error {
+	switch arg {
+	case "":
+		s.replayOutput = !s.replayOutput
+	case "on":
+		s.replayOutput = true
+	case "off":
+		s.replayOutput = false
+	default:
+		return fmt.Errorf("invalid argument: %s", arg)
+	}
+
+	if s.replayOutput {
+		s.infof("showing the output of all inputs")
+	} else {
+		s.infof("showing the output of the latest input")
+	}
+
+	return nil
+}
+
+func actionTimeout(s *Session, arg string) error {
+	switch arg {
+	case "":
+		if s.timeout > 0 {
+			s.infof("timeout: %s", s.timeout)
+		} else {
+			s.infof("timeout: off")
+		}
+		return nil
+	case "off":
+		s.timeout = 0
+		return nil
+	}
+
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid duration: %s", arg)
+	}
+	s.timeout = d
+
+	return nil
+}
+
+func actionLimits(s *Session, arg string) error {
+	if arg != "" {
+		if err := s.limits.set(arg); err != nil {
+			return err
+		}
+	}
+
+	s.infof("limits: %s", s.limits)
+
+	return nil
+}
+
+func actionSave(s *Session, filename string) error {
+	if filename == "" {
+		filename = fmt.Sprintf("gore_session_%s.json", time.Now().Format("20060102_150405"))
+	}
+
+	if err := s.save(filename); err != nil {
+		return err
+	}
+
+	s.infof("Session saved to %s", filename)
+
+	return nil
+}
+
+func actionLoad(s *Session, filename string) error {
+	if filename == "" {
+		return fmt.Errorf("argument is required")
+	}
+
+	if fi, err := os.Stat(filename); filepath.Ext(filename) == ".go" || err == nil && fi.IsDir() {
+		return s.includeContext(filename)
+	}
+
+	return s.load(filename)
+}
+
+func actionReload(s *Session, _ string) error {
+	return s.reload()
+}
+
+func actionList(s *Session, _ string) error {
+	s.list()
+
+	return nil
+}
+
+func actionRm(s *Session, arg string) error {
+	force := false
+	if strings.HasPrefix(arg, "-f") {
+		force = true
+		arg = strings.TrimSpace(strings.TrimPrefix(arg, "-f"))
+	}
+	if arg == "" {
+		return fmt.Errorf("argument is required")
+	}
+
+	return s.remove(arg, force)
+}
+
+func actionVars(s *Session, _ string) error {
+	return s.vars()
+}
+
+func actionDecls(s *Session, _ string) error {
+	return s.decls()
+}
+
+func actionEnter(s *Session, arg string) error {
+	if arg == "" {
+		return fmt.Errorf("argument is required")
+	}
+
+	return s.enter(arg)
+}
+
+func actionGet(s *Session, arg string) error {
+	if arg == "" {
+		return fmt.Errorf("argument is required")
+	}
+
+	return s.getModule(arg)
+}
+
+func actionMod(s *Session, _ string) error {
+	for _, r := range s.requires {
+		fmt.Fprintf(s.stdout, "%s %s\n", r.Path, r.Version)
+	}
+
+	return nil
+}
+
+// settings are the options of the session shown and set by :set.
+var settings = []struct {
+	name string
+	get  func(*Session) string
+	set  func(*Session, string) error
+}{
+	{
+		name: "lang",
+		get:  func(s *Session) string { return s.lang },
+		set:  (*Session).setLang,
+	},
+	{
+		name: "unwrap",
+		get:  func(s *Session) string { return onOff(s.unwrap) },
+		set:  (*Session).setUnwrap,
+	},
+	{
+		name: "onpanic",
+		get:  (*Session).onPanic,
+		set:  (*Session).setOnPanic,
+	},
+	{
+		name: "wait",
+		get:  (*Session).waitString,
+		set:  (*Session).setWait,
+	},
+}
+
+func actionSet(s *Session, arg string) error {
+	fields := strings.Fields(arg)
+	for _, setting := range settings {
+		if len(fields) > 0 && fields[0] != setting.name {
+			continue
+		}
+		if len(fields) > 1 {
+			return setting.set(s, strings.TrimSpace(strings.TrimPrefix(arg, fields[0])))
+		}
+		s.infof("%s: %s", setting.name, setting.get(s))
+		if len(fields) > 0 {
+			return nil
+		}
+	}
+	if len(fields) > 0 {
+		return fmt.Errorf("unknown option: %s", fields[0])
+	}
+
+	return nil
+}
+
+func completeSet(s *Session, prefix string) []string {
+	var result []string
+	for _, setting := range settings {
+		if strings.HasPrefix(setting.name, prefix) {
+			result = append(result, setting.name)
+		}
+	}
+	return result
+}
+
+func actionUndo(s *Session, arg string) error {
+	n, err := parseCount(arg)
+	if err != nil {
+		return err
+	}
+
+	return s.undo(n)
+}
+
+func actionRedo(s *Session, arg string) error {
+	n, err := parseCount(arg)
+	if err != nil {
+		return err
+	}
+
+	return s.redo(n)
+}
+
+// parseCount parses an optional positive count argument, which defaults to 1.
+func parseCount(arg string) (int, error) {
+	if arg == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count: %s", arg)
+	}
+
+	return n, nil
+}
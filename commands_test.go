@@ -2,7 +2,13 @@ package gore
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -38,8 +44,8 @@ int
 float64
 func() []int
 []int
-func(a ...interface{}) string
-func(a ...interface{}) (n int, err error)
+func(a ...any) string
+func(a ...any) (n int, err error)
 func(w io.Writer) *encoding/json.Encoder
 `, stdout.String())
 	assert.Equal(t, `type: cannot get type: x
@@ -47,6 +53,33 @@ type: cannot get type: fmt
 `, stderr.String())
 }
 
+func TestAction_TypeGenerics(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`func Map[T, U any](xs []T, f func(T) U) []U { return nil }`,
+		`type Pair[K comparable, V any] struct { Key K; Val V }`,
+		`:type Map`,
+		`:type Map[int, string]`,
+		`:type Map([]int{1}, func(i int) bool { return i > 0 })`,
+		`:type Pair[string, int]{}`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `func[T, U any](xs []T, f func(T) U) []U
+func(xs []int, f func(int) string) []string
+[]bool
+Pair[string, int]
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
 func TestAction_Doc(t *testing.T) {
 	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
 	s, err := NewSession(stdout, stderr)
@@ -128,7 +161,396 @@ func TestAction_Clear(t *testing.T) {
 "foo"
 "foo"
 `, stdout.String())
-	assert.Equal(t, "undefined: x\n", stderr.String())
+	assert.Equal(t, "[in #5, col 1] undefined: x\n", stderr.String())
+}
+
+func TestAction_UndoRedo(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`x := 1`,
+		`x = 2`,
+		`:undo`,
+		`:redo`,
+		`x`,
+		`:undo 3`,
+		`x := "foo"`,
+		`:redo`,
+		`:clear`,
+		`:undo`,
+		`x`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `1
+2
+2
+"foo"
+"foo"
+`, stdout.String())
+	assert.Equal(t, "redo: nothing to redo\n", stderr.String())
+}
+
+func TestAction_UndoLoad(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	ctx := filepath.Join(dir, "ctx.go")
+	require.NoError(t, ioutil.WriteFile(ctx, []byte("package ctx\n\nfunc helper() int { return 1 }\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "foo"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo", "foo.go"), []byte("package foo\n\nconst Foo = 1\n"), 0644))
+
+	require.NoError(t, s.Eval(`:load `+ctx))
+	require.NoError(t, s.Eval(`:load `+filepath.Join(dir, "foo")))
+
+	// the package is included again after undoing its :load
+	require.NoError(t, s.Eval(`:undo`))
+	require.NoError(t, s.Eval(`:load `+filepath.Join(dir, "foo")))
+	require.NoError(t, s.Eval(`helper() + foo.Foo`))
+
+	// the file is still reloaded after undoing :clear
+	require.NoError(t, s.Eval(`:clear`))
+	require.NoError(t, s.Eval(`:undo`))
+	require.NoError(t, ioutil.WriteFile(ctx, []byte("package ctx\n\nfunc helper() int { return 2 }\n"), 0644))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(ctx, later, later))
+	require.NoError(t, s.Eval(`helper() + foo.Foo`))
+
+	assert.Equal(t, "2\n3\n", stdout.String())
+	assert.Len(t, s.contexts, 1)
+	assert.Len(t, s.contextPkgs, 1)
+}
+
+func TestAction_ListRm(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`func double(n int) int { return n * 2 }`,
+		`x := 10`,
+		`fmt.Println(double(x))`,
+		`:list`,
+		`:rm double`,
+		`:rm 3`,
+		`:list`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `10
+20
+3
+<nil>
+   #1 func double(n int) int { return n * 2 }
+   #2 x := 10
+   #3 fmt.Println(double(x))
+   #1 func double(n int) int { return n * 2 }
+   #2 x := 10
+`, stdout.String())
+	assert.Equal(t, `rm: would break other inputs (use -f to remove anyway):
+   #3 undefined: double
+`, stderr.String())
+
+	inputs := make([]string, len(s.inputs))
+	for i, in := range s.inputs {
+		inputs[i] = in.src
+	}
+	assert.Equal(t, []string{`func double(n int) int { return n * 2 }`, `x := 10`}, inputs)
+}
+
+func TestAction_ListRm_Import(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	s.autoImport = true
+
+	codes := []string{
+		`import "fmt"`,
+		`strings.ToUpper("a")`,
+		`:list`,
+		`:rm fmt`,
+		`:rm strings`,
+		`:list`,
+		`fmt.Sprint(1)`,
+	}
+
+	for _, code := range codes {
+		require.NoError(t, s.Eval(code), code)
+	}
+
+	// fmt is imported by the initial source as well, and stays imported
+	assert.Equal(t, `"A"
+   #1 import "fmt"
+   #2 import "strings"
+   #2 strings.ToUpper("a")
+"1"
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestAction_VarsDecls(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`func double(n int) int { return n * 2 }`,
+		`:define type T struct{ A int }`,
+		`:define const c = 5`,
+		`:define var v = []T{{1}}`,
+		`x := double(c)`,
+		`s := fmt.Sprint(x, v)`,
+		`:vars`,
+		`:decls`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `10
+"10 [{1}]"
+#4  var  v  []T
+#5  var  x  int
+#6  var  s  string
+#1  func   double  func(n int) int
+#2  type   T       struct{A int}
+#3  const  c       untyped int = 5
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestAction_SetLang(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`:set lang go1.21`,
+		`for i := range 3 { fmt.Print(i) }`,
+		`:set lang 1.22`,
+		`for i := range 3 { fmt.Print(i) }`,
+		`:set lang go1.x`,
+		`:set foo`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, "012", stdout.String())
+	assert.Equal(t, `[in #1, col 16] cannot range over 3 (untyped int constant): requires go1.22 or later (-lang was set to go1.21; use :set lang to change it)
+set: invalid language version: go1.x (must be like go1.21)
+set: unknown option: foo
+`, stderr.String())
+	assert.Contains(t, string(s.goMod()), "\ngo 1.22\n")
+}
+
+func TestAction_Enter(t *testing.T) {
+	dir := t.TempDir()
+	src := `package p
+
+import "strings"
+
+type T struct{ n int }
+
+func (t *T) Inc(by int) int {
+	t.n += by
+	return t.n
+}
+
+func Greet(name string, times int) string {
+	upper := strings.ToUpper(name)
+	if times > 1 {
+		repeated := strings.Repeat(upper, times)
+		return repeated
+	}
+	return upper
+}
+
+func Early(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n * 2
+}
+
+func Sum(ns []int) int {
+	total := 0
+	for _, n := range ns {
+		total += n
+	}
+	return total
+}
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/p\n\ngo 1.21\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644))
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	require.NoError(t, s.enterModule(dir))
+
+	// packages are found from the session module as gore does
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(s.tempDir))
+	defer os.Chdir(wd)
+
+	codes := []string{
+		`:enter ` + filepath.Join(dir, "p.go") + `:16("go", 2)`,
+		`len(repeated)`,
+		`:enter (*T).Inc(5)`,
+		`t.n * 2`,
+		`:enter p.Early(-1)`,
+		`:enter Missing`,
+		`:enter ` + filepath.Join(dir, "p.go") + `:31`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `"GOGO"
+4
+5
+10
+`, stdout.String())
+	assert.Contains(t, stderr.String(), "panic: gore: returned before the line")
+	assert.Contains(t, stderr.String(), "enter: Early does not run to line 25\n")
+	assert.Contains(t, stderr.String(), "enter: function not found in example.com/p: Missing\n")
+	assert.Contains(t, stderr.String(), "enter: line 31 is inside the range statement at line 30; enter at a line outside it\n")
+}
+
+func TestAction_LoadReload(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	ctx := filepath.Join(t.TempDir(), "ctx.go")
+	modTime := time.Now()
+	write := func(src string) {
+		require.NoError(t, ioutil.WriteFile(ctx, []byte(src), 0644))
+		// the changes are detected by the modification times
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(ctx, modTime, modTime))
+	}
+
+	write("package ctx\n\nfunc helper() int { return 1 }\n")
+	require.NoError(t, s.Eval(`:load `+ctx))
+	require.NoError(t, s.Eval(`var total = helper() + 1`))
+	require.NoError(t, s.Eval(`helper()`))
+
+	write("package ctx\n\nfunc helper() int { return 2 }\n")
+	require.NoError(t, s.Eval(`helper()`))
+
+	// breaks total; the previous version is kept
+	write("package ctx\n\nfunc helper() string { return \"x\" }\n")
+	require.NoError(t, s.Eval(`helper()`))
+
+	err = s.Eval(`:reload`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ctx+" (keeping the previous version):\n   #1 invalid operation")
+
+	require.NoError(t, ioutil.WriteFile(ctx, []byte("package ctx\n\nfunc helper() int { return 3 }\n"), 0644))
+	require.NoError(t, s.Eval(`:reload`))
+	require.NoError(t, s.Eval(`total`))
+
+	assert.Equal(t, "2\n1\n2\n2\n4\n", stdout.String())
+}
+
+func TestAction_LoadPackage(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	write := func(name, src string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+	}
+	// the packages refer to their other files and declare the same names
+	write("foo/foo.go", "package foo\n\nfunc Hello() string { return greeting }\n")
+	write("foo/greeting.go", "package foo\n\nvar greeting = \"foo\"\n")
+	write("bar/bar.go", "package bar\n\nfunc Hello() string { return \"bar\" }\n")
+	write("baz/main.go", "package main\n\nfunc main() {}\n")
+
+	require.NoError(t, s.Eval(`:load `+filepath.Join(dir, "foo")))
+	require.NoError(t, s.includeContext(filepath.Join(dir, "bar")))
+	require.NoError(t, s.Eval(`foo.Hello() + bar.Hello()`))
+
+	write("foo/greeting.go", "package foo\n\nvar greeting = \"FOO\"\n")
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "foo/greeting.go"), later, later))
+	require.NoError(t, s.Eval(`foo.Hello() + bar.Hello()`))
+
+	// breaks foo; the previous copy is kept
+	write("foo/greeting.go", "package foo\n\nvar greeting = 1\n")
+	later = later.Add(time.Second)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "foo/greeting.go"), later, later))
+	require.NoError(t, s.Eval(`foo.Hello() + bar.Hello()`))
+	assert.Contains(t, stderr.String(), "error: gore_session/context/foo (keeping the previous version):\n")
+
+	err = s.Eval(`:load ` + filepath.Join(dir, "baz"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot import package main")
+
+	assert.Equal(t, `"foobar"`+"\n"+`"FOObar"`+"\n"+`"FOObar"`+"\n", stdout.String())
+	assert.Equal(t, []string{"gore_session/context/foo", "gore_session/context/bar"}, []string{s.contextPkgs[0].importPath, s.contextPkgs[1].importPath})
+}
+
+func TestAction_GetMod(t *testing.T) {
+	// the module is resolved from the module cache
+	t.Setenv("GOPROXY", "off")
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`:get github.com/google/uuid@v1.1.0`,
+		`:import github.com/google/uuid`,
+		`uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8").String()`,
+		// NewString is added in v1.2.0
+		`:get github.com/google/uuid@v1.3.0`,
+		`:type uuid.NewString`,
+		`:mod`,
+		`:get`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `"6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+func() string
+github.com/google/uuid v1.3.0
+`, stdout.String())
+	assert.Contains(t, stderr.String(), "get: argument is required\n")
+	assert.Contains(t, string(s.goMod()), "\tgithub.com/google/uuid v1.3.0")
+	require.Len(t, s.inputs, 4)
+	assert.Equal(t, `:get github.com/google/uuid@v1.1.0`, s.inputs[0].src)
 }
 
 func TestAction_Help(t *testing.T) {
@@ -216,3 +638,219 @@ type: argument is required
 doc: argument is required
 `, stderr.String())
 }
+
+func TestAction_SaveLoad(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	s.persist = true
+
+	filename := filepath.Join(s.tempDir, "session.json")
+
+	codes := []string{
+		`:import fmt`,
+		`:timeout 1m`,
+		`:set lang go1.21`,
+		`x := 10`,
+		`func f(n int) string { return fmt.Sprint(n) }`,
+		`:define const c = 5`,
+		":save " + filename,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, `{
+  "version": 1,
+  "options": {
+    "autoimport": false,
+    "persist": true,
+    "replay": false,
+    "timeout": "1m0s",
+    "lang": "go1.21"
+  },
+  "inputs": [
+    ":import fmt",
+    "x := 10",
+    "func f(n int) string { return fmt.Sprint(n) }",
+    ":define const c = 5"
+  ]
+}
+`, string(b))
+
+	stdout.Reset()
+	stderr.Reset()
+
+	s2, err := NewSession(stdout, stderr)
+	defer s2.Clear()
+	require.NoError(t, err)
+
+	err = s2.Eval(":load " + filename)
+	require.NoError(t, err)
+	assert.True(t, s2.persist)
+	assert.Equal(t, time.Minute, s2.timeout)
+	assert.Equal(t, "go1.21", s2.lang)
+
+	err = s2.Eval("f(x + c)")
+	require.NoError(t, err)
+
+	assert.Equal(t, "\"15\"\n", stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestAction_SaveLoad_Context(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	helper := filepath.Join(dir, "helper.go")
+	require.NoError(t, ioutil.WriteFile(helper, []byte("package helper\n\nfunc double(n int) int { return n * 2 }\n"), 0644))
+	greet := filepath.Join(dir, "greet")
+	require.NoError(t, os.MkdirAll(greet, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(greet, "greet.go"), []byte("package greet\n\nfunc Hello() string { return \"hello\" }\n"), 0644))
+
+	filename := filepath.Join(s.tempDir, "session.json")
+	for _, code := range []string{
+		`:load ` + helper,
+		`:load ` + greet,
+		`var n = double(len(greet.Hello()))`,
+		`:save ` + filename,
+	} {
+		require.NoError(t, s.Eval(code))
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `  "context": [
+    "`+helper+`",
+    "`+greet+`"
+  ],`)
+
+	stdout.Reset()
+
+	s2, err := NewSession(stdout, stderr)
+	defer s2.Clear()
+	require.NoError(t, err)
+
+	require.NoError(t, s2.Eval(":load "+filename))
+	require.NoError(t, s2.Eval("double(n) + len(greet.Hello())"))
+	assert.Equal(t, "10\n25\n", stdout.String())
+
+	// loading again does not include them twice
+	require.NoError(t, s2.Eval(":load "+filename))
+	assert.Len(t, s2.contexts, 1)
+	assert.Len(t, s2.contextPkgs, 1)
+}
+
+func TestAction_Load_Failure(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	filename := filepath.Join(s.tempDir, "session.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`{
+  "version": 1,
+  "options": {"autoimport": false, "persist": false, "replay": false, "timeout": "1m0s"},
+  "inputs": ["y := 1", "y +"]
+}
+`), 0644))
+
+	require.NoError(t, s.Eval(`x := 10`))
+	err = s.Eval(`:load ` + filename)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), filename+": input 2: ")
+
+	// the session is left as it was
+	require.NoError(t, s.Eval(`x`))
+	assert.Equal(t, "10\n10\n", stdout.String())
+	assert.Equal(t, time.Duration(0), s.timeout)
+	assert.Len(t, s.inputs, 2)
+}
+
+func TestSession_RegisterCommand(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	fixture := Command{
+		Name: "f[ixture]",
+		Action: func(s *Session, arg string) error {
+			if arg == "" {
+				return errors.New("no fixture")
+			}
+			fmt.Fprintf(s.Stdout(), "loaded %s\n", arg)
+			return nil
+		},
+		Complete: func(s *Session, arg string) []string {
+			return []string{"users", "orders"}
+		},
+		Arg:  "<name>",
+		Help: "load a fixture",
+	}
+	require.NoError(t, s.RegisterCommand(fixture))
+
+	for _, cmd := range []Command{
+		{Name: "fixture", Action: fixture.Action},
+		{Name: "do", Action: fixture.Action},
+		{Name: "f[oo", Action: fixture.Action},
+		{Name: "[db]", Action: fixture.Action},
+		{Name: "db x", Action: fixture.Action},
+		{Name: "db"},
+	} {
+		assert.Error(t, s.RegisterCommand(cmd), cmd.Name)
+	}
+
+	require.NoError(t, s.Eval(":fi users"))
+	require.NoError(t, s.Eval(":fixture   orders "))
+	assert.Error(t, s.Eval(":fixture"))
+	assert.Equal(t, "loaded users\nloaded orders\n", stdout.String())
+	assert.Equal(t, "fixture: no fixture\n", stderr.String())
+
+	stdout.Reset()
+	require.NoError(t, s.Eval(":help"))
+	assert.Regexp(t, `(?m)^    :fixture <name>\s+load a fixture$`, stdout.String())
+
+	_, cands, _ := s.completeWord(":fix", 4)
+	assert.Equal(t, []string{":fixture "}, cands)
+	_, cands, _ = s.completeWord(":fixture u", 10)
+	assert.Equal(t, []string{"users", "orders"}, cands)
+
+	other, err := NewSession(new(bytes.Buffer), new(bytes.Buffer))
+	defer other.Clear()
+	require.NoError(t, err)
+	assert.Error(t, other.Eval(":fixture users"))
+}
+
+func TestAction_Print(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	file := filepath.Join(s.tempDir, "written.go")
+	for _, code := range []string{
+		`x := 1`,
+		`x := x + 1`,
+		`:print`,
+		`:write ` + file,
+	} {
+		require.NoError(t, s.Eval(code))
+	}
+
+	written, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	for _, source := range []string{stdout.String(), string(written)} {
+		assert.Contains(t, source, "x := 1")
+		assert.Contains(t, source, "x := x + 1")
+		assert.NotContains(t, source, markerName+"(1)")
+		assert.NotContains(t, source, "__gore_x_")
+	}
+}
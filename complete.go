@@ -27,7 +27,7 @@ func (s *Session) completeWord(line string, pos int) (string, []string, string)
 		if !strings.Contains(in, " ") {
 			pre, post := line[:idx], line[pos:]
 			var result []string
-			for _, command := range commands {
+			for _, command := range s.allCommands() {
 				name := pre + fmt.Sprint(command.name)
 				if cmd == "" || command.name.matchesPrefix(cmd) {
 					if !strings.HasPrefix(post, " ") && command.arg != "" {
@@ -40,7 +40,7 @@ func (s *Session) completeWord(line string, pos int) (string, []string, string)
 		}
 
 		// complete command arguments
-		for _, command := range commands {
+		for _, command := range s.allCommands() {
 			if command.complete == nil || !command.name.matches(cmd) {
 				continue
 			}
@@ -62,7 +62,7 @@ func (s *Session) completeWord(line string, pos int) (string, []string, string)
 	// code completion
 	pos, cands, err := s.completeCode(line, pos, true)
 	if err != nil {
-		errorf("completeCode: %s", err)
+		s.errorf("completeCode: %s", err)
 		return "", nil, ""
 	}
 
@@ -95,7 +95,7 @@ func (s *Session) completeCode(in string, pos int, exprMode bool) (keep int, can
 	candidates = make([]string, 0, len(result.Candidates))
 	for _, e := range result.Candidates {
 		cand := e.Name
-		if cand == printerName && e.Class == "func" {
+		if isHelperName(cand) && e.Class == "func" {
 			continue
 		}
 		if exprMode && e.Class == "func" {
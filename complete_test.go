@@ -44,6 +44,22 @@ func TestSession_completeWord(t *testing.T) {
 		" : :edit ",
 		" : :run",
 		" : :define ",
+		" : :replay ",
+		" : :timeout ",
+		" : :limits ",
+		" : :save ",
+		" : :load ",
+		" : :reload",
+		" : :list",
+		" : :rm ",
+		" : :vars",
+		" : :decls",
+		" : :enter ",
+		" : :get ",
+		" : :mod",
+		" : :set ",
+		" : :undo ",
+		" : :redo ",
 	}, cands)
 	assert.Equal(t, post, "")
 
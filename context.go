@@ -0,0 +1,603 @@
+package gore
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go/ast"
+	"go/parser"
+	"go/token"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Live reloading
+//
+// Files included by -context or :load, and the package of -pkg, are checked
+// for changes on disk before each input and re-included if they have changed,
+// so that helper code can be edited while keeping the session. A changed file
+// or package which does not compile with the session is reported and its
+// previous version is kept. :reload re-includes them all at once.
+//
+// The previous versions of the packages copied into the session module are
+// their copies. For the other packages, the files of the last version which
+// compiled are saved, and kept in place of those on disk by the overlay of
+// the go command (see "go help build") and the importer of the session.
+//
+// -context and :load also take directories and import paths, which are
+// included as packages imported by the session instead of being merged into
+// package main, so that their files can refer to each other and identifiers
+// of different packages do not collide. Packages of the modules of the
+// session (see enterModule) and those required by :get are imported by their
+// import paths; other directories are copied into the session module
+// under gore_session/context/<name>.
+
+// contextFile is a file included by -context or :load.
+type contextFile struct {
+	path     string // the file on disk
+	tempPath string // its copy for package main in extraFilePaths
+	modTime  time.Time
+}
+
+// contextPackage is a package included by -context or :load.
+type contextPackage struct {
+	dir        string // the directory of the package
+	name       string
+	importPath string
+	copyDir    string // the copy in the session module, if dir is outside it
+	modTime    time.Time
+}
+
+// includeContext includes the file, the directory or the package specified
+// by path into the session.
+func (s *Session) includeContext(path string) error {
+	if filepath.Ext(path) == ".go" {
+		if err := s.includeContextFile(path); err != nil {
+			return err
+		}
+		s.infof("added file %s", path)
+		return nil
+	}
+
+	p, err := s.includeContextPackage(path)
+	if err != nil {
+		return err
+	}
+	s.infof("added package %s", p.importPath)
+	return nil
+}
+
+// includeContextFile includes the file at path into package main.
+func (s *Session) includeContextFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := s.importPackages(content); err != nil {
+		return err
+	}
+
+	if err := s.importFile(content); err != nil {
+		return err
+	}
+
+	s.contexts = append(s.contexts, &contextFile{
+		path:     path,
+		tempPath: s.extraFilePaths[len(s.extraFilePaths)-1],
+		modTime:  fi.ModTime(),
+	})
+
+	return nil
+}
+
+// includeContextPackage includes the package in the directory or of
+// the import path specified by path, and imports it into the session.
+func (s *Session) includeContextPackage(path string) (*contextPackage, error) {
+	p := &contextPackage{}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		dir, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		bp, err := build.ImportDir(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		p.dir, p.name = dir, bp.Name
+		if importPath, ok := s.hostImportPath(dir); ok {
+			p.importPath = importPath
+		} else {
+			p.copyDir = filepath.Join(s.tempDir, "context", bp.Name)
+			p.importPath = s.modulePath() + "/context/" + bp.Name
+		}
+	} else {
+		lp, err := s.listPackage(path)
+		if err != nil {
+			return nil, err
+		}
+		p.dir, p.name, p.importPath = lp.Dir, lp.Name, lp.ImportPath
+	}
+
+	if p.name == "main" {
+		return nil, fmt.Errorf("%s: cannot import package main; include its files instead", path)
+	}
+	for _, q := range s.contextPkgs {
+		if q.name == p.name {
+			return nil, fmt.Errorf("%s: package %s is already included from %s", path, p.name, q.dir)
+		}
+	}
+
+	p.modTime = latestModTime(p.dir)
+	if p.copyDir != "" {
+		if err := copyPackageFiles(p.dir, p.copyDir, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := s.types.Importer.Import(p.importPath); err != nil {
+		if p.copyDir != "" {
+			os.RemoveAll(p.copyDir)
+		}
+		return nil, err
+	}
+	if p.copyDir == "" {
+		if err := s.saveVersion(p.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	s.contextPkgs = append(s.contextPkgs, p)
+	s.importContextPackage(p)
+
+	return p, nil
+}
+
+// importContextPackage adds the import of p to the session file.
+func (s *Session) importContextPackage(p *contextPackage) {
+	if astutil.AddImport(s.fset, s.file, p.importPath) {
+		s.declInputs[strconv.Quote(p.importPath)] = s.inputNo
+	}
+}
+
+// hostImportPath returns the import path of the package in dir
+// if dir is in one of the host modules.
+func (s *Session) hostImportPath(dir string) (string, bool) {
+	var module, importPath string
+	for _, m := range s.hostModules {
+		rel, err := filepath.Rel(m.Dir, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// the innermost module containing dir
+		if len(m.Path) > len(module) {
+			module, importPath = m.Path, path.Join(m.Path, filepath.ToSlash(rel))
+		}
+	}
+	return importPath, module != ""
+}
+
+// copyPackageFiles copies the files of the package in dir to dst,
+// except for the test files unless tests is true.
+func copyPackageFiles(dir, dst string, tests bool) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !tests && strings.HasSuffix(fi.Name(), "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, fi.Name()), b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reloadChanged re-includes the files and the packages changed on disk,
+// reporting the errors.
+func (s *Session) reloadChanged() {
+	var files []*contextFile
+	for _, c := range s.contexts {
+		if fi, err := os.Stat(c.path); err == nil && !fi.ModTime().Equal(c.modTime) {
+			files = append(files, c)
+		}
+	}
+	var pkgs []*contextPackage
+	for _, p := range s.contextPkgs {
+		if latestModTime(p.dir).After(p.modTime) {
+			pkgs = append(pkgs, p)
+		}
+	}
+	pkgChanged := s.pkg != nil && s.pkg.changed()
+	if len(files) == 0 && len(pkgs) == 0 && !pkgChanged {
+		return
+	}
+
+	// positions are needed to locate errors
+	if err := s.reset(); err != nil {
+		s.errorf("%s", err)
+		return
+	}
+
+	for _, c := range files {
+		if err := s.reloadContext(c); err != nil {
+			s.errorf("%s", err)
+			continue
+		}
+		s.infof("reloaded file %s", c.path)
+	}
+
+	for _, p := range pkgs {
+		if err := s.reloadContextPackage(p); err != nil {
+			s.errorf("%s", err)
+		}
+	}
+
+	if pkgChanged {
+		if err := s.reloadPackage(); err != nil {
+			s.errorf("%s", err)
+		}
+	}
+}
+
+// reload re-includes all the files and the packages.
+func (s *Session) reload() error {
+	// positions are needed to locate errors
+	if err := s.reset(); err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, c := range s.contexts {
+		if err := s.reloadContext(c); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, p := range s.contextPkgs {
+		if err := s.reloadContextPackage(p); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if s.pkg != nil {
+		if err := s.reloadPackage(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// reloadContext re-includes c, keeping the previous version if the new one
+// does not compile with the session.
+func (s *Session) reloadContext(c *contextFile) error {
+	i := -1
+	for j, path := range s.extraFilePaths {
+		if path == c.tempPath {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("%s: not included", c.path)
+	}
+
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	c.modTime = fi.ModTime()
+
+	f, err := s.parseContextFile(c.tempPath, content)
+	if err != nil {
+		return fmt.Errorf("%s", strings.Replace(err.Error(), c.tempPath, c.path, -1))
+	}
+
+	old := s.extraFiles[i]
+	before := s.typeErrorMsgs()
+	s.extraFiles[i] = f
+	if errs := s.newTypeErrors(before, c); len(errs) > 0 {
+		s.extraFiles[i] = old
+		return fmt.Errorf("%s (keeping the previous version):\n%s", c.path, strings.Join(errs, "\n"))
+	}
+
+	if err := s.importPackages(content); err != nil {
+		return err
+	}
+
+	// the saved state may contain the values of the previous version
+	s.statePath = ""
+
+	return writeContextFile(s.fset, c.tempPath, f)
+}
+
+// reloadContextPackage re-includes p, keeping the previous version if the new
+// one does not compile with the session.
+func (s *Session) reloadContextPackage(p *contextPackage) error {
+	before := s.typeErrorMsgs()
+
+	p.modTime = latestModTime(p.dir)
+	prevDir := p.copyDir + ".prev"
+	if p.copyDir != "" {
+		os.RemoveAll(prevDir)
+		if err := os.Rename(p.copyDir, prevDir); err != nil {
+			return err
+		}
+		if err := copyPackageFiles(p.dir, p.copyDir, false); err != nil {
+			os.RemoveAll(p.copyDir)
+			os.Rename(prevDir, p.copyDir)
+			return err
+		}
+	} else {
+		s.unkeepVersion(p.dir)
+	}
+	// the importer caches the previous version
+	s.types.Importer = s.newImporter()
+
+	errs := s.newTypeErrors(before, nil)
+	if len(errs) == 0 {
+		// the importer does not check the function bodies
+		errs = s.buildErrors(p)
+	}
+	if len(errs) > 0 {
+		if p.copyDir != "" {
+			os.RemoveAll(p.copyDir)
+			os.Rename(prevDir, p.copyDir)
+		} else if err := s.keepVersion(p.dir); err != nil {
+			return err
+		}
+		s.types.Importer = s.newImporter()
+		return fmt.Errorf("%s (keeping the previous version):\n%s", p.importPath, strings.Join(errs, "\n"))
+	}
+
+	if p.copyDir != "" {
+		os.RemoveAll(prevDir)
+	} else if err := s.saveVersion(p.dir); err != nil {
+		return err
+	}
+	s.statePath = ""
+
+	s.infof("reloaded package %s", p.importPath)
+
+	return nil
+}
+
+// reloadPackage lists the package of -pkg again, keeping the previous version
+// if the new one does not compile with the session.
+func (s *Session) reloadPackage() error {
+	before := s.typeErrorMsgs()
+
+	prev := s.pkg
+	keep := func(err error) error {
+		s.pkg = prev
+		prev.modTime = latestModTime(prev.Dir)
+		if err := s.keepVersion(prev.Dir); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s (keeping the previous version):\n%s", prev.ImportPath, err)
+	}
+
+	s.unkeepVersion(prev.Dir)
+	pkg, err := s.listPackage(prev.Dir)
+	if err != nil {
+		return keep(err)
+	}
+	s.pkg = pkg
+	if _, err := s.packageFiles(); err != nil {
+		return keep(err)
+	}
+	s.enterPackage()
+
+	if errs := s.newTypeErrors(before, nil); len(errs) > 0 {
+		return keep(fmt.Errorf("%s", strings.Join(errs, "\n")))
+	}
+
+	if err := s.saveVersion(pkg.Dir); err != nil {
+		return err
+	}
+	s.statePath = ""
+
+	s.infof("reloaded package %s", pkg.ImportPath)
+
+	return nil
+}
+
+// buildErrors compiles p as the session does and returns the errors.
+func (s *Session) buildErrors(p *contextPackage) []string {
+	args := []string{"build"}
+	if len(s.kept) > 0 {
+		overlayPath, err := s.writeOverlay(map[string]string{})
+		if err != nil {
+			return []string{err.Error()}
+		}
+		args = append(args, "-overlay", overlayPath)
+	}
+	cmd := exec.Command("go", append(args, p.importPath)...)
+	cmd.Dir = s.tempDir
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	// the errors in the copy are located in p
+	copyDir := ""
+	if p.copyDir != "" {
+		if rel, err := filepath.Rel(s.tempDir, p.copyDir); err == nil {
+			copyDir = rel + string(filepath.Separator)
+		}
+	}
+	var errs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if copyDir != "" && strings.HasPrefix(line, copyDir) {
+			line = filepath.Join(p.dir, strings.TrimPrefix(line, copyDir))
+		}
+		errs = append(errs, line)
+	}
+	return errs
+}
+
+// savedDir returns the directory where the files in dir are saved.
+func (s *Session) savedDir(dir string) string {
+	return filepath.Join(s.tempDir, "saved", url.PathEscape(dir))
+}
+
+// saveVersion saves the files in dir, which compile with the session,
+// to be kept if a later version does not.
+func (s *Session) saveVersion(dir string) error {
+	return copyPackageFiles(dir, s.savedDir(dir), true)
+}
+
+// keepVersion keeps the files in dir saved by saveVersion in place of those
+// on disk, hiding the Go files added since.
+func (s *Session) keepVersion(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if filepath.Ext(fi.Name()) == ".go" {
+			s.kept[filepath.Join(dir, fi.Name())] = ""
+		}
+	}
+
+	saved := s.savedDir(dir)
+	entries, err = ioutil.ReadDir(saved)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		s.kept[filepath.Join(dir, fi.Name())] = filepath.Join(saved, fi.Name())
+	}
+	return nil
+}
+
+// unkeepVersion uses the files in dir on disk again.
+func (s *Session) unkeepVersion(dir string) {
+	for path := range s.kept {
+		if filepath.Dir(path) == dir {
+			delete(s.kept, path)
+		}
+	}
+}
+
+// parseKeptFile parses the file at path, or its saved version if it is kept
+// (see keepVersion). It returns nil if the file is hidden.
+func parseKeptFile(fset *token.FileSet, kept map[string]string, path string) (*ast.File, error) {
+	var src interface{}
+	if saved, ok := kept[path]; ok {
+		if saved == "" {
+			return nil, nil
+		}
+		b, err := ioutil.ReadFile(saved)
+		if err != nil {
+			return nil, err
+		}
+		src = b
+	}
+	return parser.ParseFile(fset, path, src, parser.Mode(0))
+}
+
+// keptFiles returns the files in dir which are kept although
+// they are not on disk.
+func keptFiles(kept map[string]string, dir string, onDisk []string) []string {
+	listed := map[string]bool{}
+	for _, name := range onDisk {
+		listed[name] = true
+	}
+	var names []string
+	for path, saved := range kept {
+		name := filepath.Base(path)
+		if filepath.Dir(path) == dir && saved != "" && filepath.Ext(name) == ".go" && !listed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// typeErrorMsgs type-checks the session and returns the error messages.
+func (s *Session) typeErrorMsgs() map[string]bool {
+	msgs := map[string]bool{}
+	for _, err := range s.typeErrors(s.file.Decls, s.mainBody.List) {
+		msgs[err.Msg] = true
+	}
+	return msgs
+}
+
+// newTypeErrors type-checks the session and formats the errors whose messages
+// are not in before with their positions, in c (if not nil) or in the session.
+func (s *Session) newTypeErrors(before map[string]bool, c *contextFile) []string {
+	var lines []string
+	entries := s.entries()
+	for _, err := range s.typeErrors(s.file.Decls, s.mainBody.List) {
+		if before[err.Msg] {
+			continue
+		}
+		pos := s.fset.Position(err.Pos)
+		if c != nil && pos.Filename == c.tempPath {
+			lines = append(lines, fmt.Sprintf("%s:%d:%d: %s", c.path, pos.Line, pos.Column, err.Msg))
+		} else {
+			lines = append(lines, fmt.Sprintf("%5s %s", s.inputAt(entries, err.Pos), err.Msg))
+		}
+	}
+	return lines
+}
+
+// changed reports whether the Go files in the directory of the package
+// have changed since it was listed.
+func (p *targetPackage) changed() bool {
+	return latestModTime(p.Dir).After(p.modTime)
+}
+
+// latestModTime returns the latest modification time of the Go files in dir.
+func latestModTime(dir string) time.Time {
+	var latest time.Time
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return latest
+	}
+	for _, fi := range entries {
+		if filepath.Ext(fi.Name()) == ".go" && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,460 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Entering a function
+//
+// :enter (and gore -at) starts a session inside a function of a package:
+// the session is evaluated in the package (see pkg.go), and its first input
+// declares the receiver and the parameters of the function, followed by
+// the statements of the function body which run before the given line.
+// Parameters are zero values unless arguments are given, e.g.
+//
+//	:enter server.go:42
+//	:enter example.com/pkg.Func(1, "x")
+//	:enter (*T).Method
+//
+// The statements are taken from the top level of the body, descending into
+// the blocks and the branches of if statements which contain the line; a line
+// inside a loop, a switch or a select statement cannot be entered. Returns
+// before the line are replaced by panics, as the line is not reached.
+
+// enterReturnedMessage is the panic message replacing returns before the line.
+const enterReturnedMessage = "gore: returned before the line"
+
+var fileLineRegexp = regexp.MustCompile(`^(.+\.go):(\d+)$`)
+
+// enter builds a session inside the function specified by target.
+func (s *Session) enter(target string) error {
+	spec, argsSrc := splitArgs(target)
+
+	var args []ast.Expr
+	if strings.TrimSpace(argsSrc) != "" {
+		call, err := parser.ParseExpr("f(" + argsSrc + ")")
+		if err != nil {
+			return fmt.Errorf("invalid arguments: %s", argsSrc)
+		}
+		args = call.(*ast.CallExpr).Args
+	}
+
+	pkgPath, name, file, line, err := s.parseEnterSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	switchPkg := pkgPath != "" && (s.pkg == nil || (s.pkg.ImportPath != pkgPath && s.pkg.Dir != pkgPath))
+	if switchPkg {
+		s.pkg = nil
+	}
+	if err := s.init(); err != nil {
+		return err
+	}
+	// the code of the session before cannot be undone into
+	s.undoStack, s.redoStack = nil, nil
+
+	if switchPkg {
+		if err := s.includePackage(pkgPath); err != nil {
+			return err
+		}
+	}
+	if s.pkg == nil {
+		return fmt.Errorf("no package to enter; specify <file>:<line> or <package>.<func>")
+	}
+
+	files, err := s.packageFiles()
+	if err != nil {
+		return err
+	}
+
+	decl, f := findFunc(s.fset, files, name, file, line)
+	if decl == nil {
+		if name != "" {
+			return fmt.Errorf("function not found in %s: %s", s.pkg.ImportPath, name)
+		}
+		return fmt.Errorf("no function at %s:%d", file, line)
+	}
+	if decl.Body == nil {
+		return fmt.Errorf("%s has no body", declKey(decl))
+	}
+	if decl.Type.TypeParams != nil || (decl.Recv != nil && len(decl.Recv.List) > 0 && recvTypeParams(decl.Recv.List[0].Type)) {
+		return fmt.Errorf("cannot enter generic function %s", declKey(decl))
+	}
+
+	if line == 0 {
+		// before the return at the end, if any
+		line = s.fset.Position(decl.Body.Rbrace).Line
+		if n := len(decl.Body.List); n > 0 {
+			if ret, ok := decl.Body.List[n-1].(*ast.ReturnStmt); ok {
+				line = s.fset.Position(ret.Pos()).Line
+			}
+		}
+	}
+
+	src, err := s.enterSource(decl, args, line)
+	if err != nil {
+		return err
+	}
+	debugf("enter :: %s", src)
+
+	s.addFileImports(f, src)
+
+	if err := s.evalStmt(src); err != nil {
+		return err
+	}
+	s.doQuickFix()
+
+	if err := s.Run(); err != nil {
+		// start over, in the package
+		if err := s.init(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s does not run to line %d", declKey(decl), line)
+	}
+
+	s.infof("entered %s at line %d", declKey(decl), line)
+
+	return nil
+}
+
+// splitArgs splits "<spec>(<args>)" into spec and args.
+func splitArgs(target string) (spec, args string) {
+	target = strings.TrimSpace(target)
+	if !strings.HasSuffix(target, ")") {
+		return target, ""
+	}
+
+	// the parenthesis matching the last one, as in "(*T).M(x)"
+	depth := 0
+	for i := len(target) - 1; i >= 0; i-- {
+		switch target[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				if i == 0 {
+					return target, ""
+				}
+				return strings.TrimSpace(target[:i]), target[i+1 : len(target)-1]
+			}
+		}
+	}
+	return target, ""
+}
+
+// parseEnterSpec parses "<file>:<line>" or "[<package>.]<func>", returning
+// the package (a directory for files) and the function or the position.
+func (s *Session) parseEnterSpec(spec string) (pkgPath, name, file string, line int, err error) {
+	if m := fileLineRegexp.FindStringSubmatch(spec); m != nil {
+		file = m[1]
+		if !filepath.IsAbs(file) {
+			dir := ""
+			if s.pkg != nil {
+				dir = s.pkg.Dir
+			} else if dir, err = os.Getwd(); err != nil {
+				return
+			}
+			file = filepath.Join(dir, file)
+		}
+		line, _ = strconv.Atoi(m[2])
+		return filepath.Dir(file), "", file, line, nil
+	}
+
+	// "(*T).M" is the same as "T.M"
+	spec = strings.NewReplacer("(", "", ")", "", "*", "").Replace(spec)
+	if spec == "" {
+		return "", "", "", 0, fmt.Errorf("argument is required")
+	}
+
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		j := strings.Index(spec[i:], ".")
+		if j < 0 {
+			return "", "", "", 0, fmt.Errorf("function name is required: %s", spec)
+		}
+		return spec[:i+j], spec[i+j+1:], "", 0, nil
+	}
+
+	parts := strings.SplitN(spec, ".", 2)
+	if len(parts) == 1 {
+		return "", spec, "", 0, nil
+	}
+	if s.pkg != nil {
+		if parts[0] == s.pkg.Name {
+			return "", parts[1], "", 0, nil
+		}
+		files, _ := s.packageFiles()
+		if decl, _ := findFunc(s.fset, files, spec, "", 0); decl != nil {
+			// a method of the current package
+			return "", spec, "", 0, nil
+		}
+	}
+	return parts[0], parts[1], "", 0, nil
+}
+
+// findFunc finds the function named name ("F" or "T.M"),
+// or the one in file whose body contains line.
+func findFunc(fset *token.FileSet, files []*ast.File, name, file string, line int) (*ast.FuncDecl, *ast.File) {
+	for _, f := range files {
+		if file != "" && fset.Position(f.Pos()).Filename != file {
+			continue
+		}
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			if name != "" {
+				if declKey(decl) == name {
+					return decl, f
+				}
+				continue
+			}
+			if decl.Body != nil && fset.Position(decl.Pos()).Line <= line && line <= fset.Position(decl.Body.Rbrace).Line {
+				return decl, f
+			}
+		}
+	}
+	return nil, nil
+}
+
+// recvTypeParams reports whether the receiver type has type parameters.
+func recvTypeParams(expr ast.Expr) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch expr.(type) {
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
+}
+
+// enterSource returns the source of the input which declares the receiver and
+// the parameters of decl and runs the statements of its body before line.
+func (s *Session) enterSource(decl *ast.FuncDecl, args []ast.Expr, line int) (string, error) {
+	var buf bytes.Buffer
+	str := func(node ast.Node) string {
+		var b bytes.Buffer
+		printer.Fprint(&b, s.fset, node)
+		return b.String()
+	}
+
+	if decl.Recv != nil {
+		for _, field := range decl.Recv.List {
+			for _, name := range field.Names {
+				if name.Name == "_" {
+					continue
+				}
+				if star, ok := field.Type.(*ast.StarExpr); ok {
+					fmt.Fprintf(&buf, "%s := new(%s)\n", name.Name, str(star.X))
+				} else {
+					fmt.Fprintf(&buf, "var %s %s\n", name.Name, str(field.Type))
+				}
+			}
+		}
+	}
+
+	i := 0
+	for _, field := range decl.Type.Params.List {
+		typ := str(field.Type)
+		if ellipsis, ok := field.Type.(*ast.Ellipsis); ok {
+			typ = "[]" + str(ellipsis.Elt)
+		}
+		names := field.Names
+		if len(names) == 0 {
+			// an unnamed parameter still takes an argument
+			names = []*ast.Ident{ast.NewIdent("_")}
+		}
+		for _, name := range names {
+			if i < len(args) {
+				if name.Name != "_" {
+					fmt.Fprintf(&buf, "var %s %s = %s\n", name.Name, typ, str(args[i]))
+				}
+			} else if name.Name != "_" {
+				fmt.Fprintf(&buf, "var %s %s\n", name.Name, typ)
+			}
+			i++
+		}
+	}
+	if len(args) > i {
+		return "", fmt.Errorf("too many arguments: %d for %d parameters", len(args), i)
+	}
+
+	if decl.Type.Results != nil {
+		for _, field := range decl.Type.Results.List {
+			for _, name := range field.Names {
+				if name.Name != "_" {
+					fmt.Fprintf(&buf, "var %s %s\n", name.Name, str(field.Type))
+				}
+			}
+		}
+	}
+
+	stmts, err := s.stmtsBefore(decl.Body.List, line)
+	if err != nil {
+		return "", err
+	}
+	for _, stmt := range stmts {
+		fmt.Fprintf(&buf, "%s\n", str(stmt))
+	}
+
+	return replaceReturns(buf.String())
+}
+
+// stmtsBefore returns the statements of list which run before line,
+// descending into the blocks and the if statements which contain the line.
+// A line inside any other statement, like a loop, is an error, as the
+// statements before it in the body do not run once.
+func (s *Session) stmtsBefore(list []ast.Stmt, line int) ([]ast.Stmt, error) {
+	var stmts []ast.Stmt
+	for _, stmt := range list {
+		if s.fset.Position(stmt.Pos()).Line >= line {
+			break
+		}
+		if s.fset.Position(stmt.End()).Line < line {
+			stmts = append(stmts, stmt)
+			continue
+		}
+
+		// the statement contains the line
+		contains := func(node ast.Node) bool {
+			return node != nil && s.fset.Position(node.Pos()).Line <= line && line <= s.fset.Position(node.End()).Line
+		}
+		var inner []ast.Stmt
+		var err error
+		switch stmt := stmt.(type) {
+		case *ast.BlockStmt:
+			inner, err = s.stmtsBefore(stmt.List, line)
+		case *ast.LabeledStmt:
+			inner, err = s.stmtsBefore([]ast.Stmt{stmt.Stmt}, line)
+		case *ast.IfStmt:
+			// the branch containing the line is taken
+			if stmt.Init != nil {
+				stmts = append(stmts, stmt.Init)
+			}
+			if contains(stmt.Body) {
+				inner, err = s.stmtsBefore(stmt.Body.List, line)
+			} else if contains(stmt.Else) {
+				inner, err = s.stmtsBefore([]ast.Stmt{stmt.Else}, line)
+			}
+		default:
+			return nil, fmt.Errorf("line %d is inside the %s at line %d; enter at a line outside it",
+				line, stmtKind(stmt), s.fset.Position(stmt.Pos()).Line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, inner...)
+		break
+	}
+	return stmts, nil
+}
+
+// stmtKind describes the kind of stmt for the errors of stmtsBefore.
+func stmtKind(stmt ast.Stmt) string {
+	switch stmt.(type) {
+	case *ast.ForStmt:
+		return "for statement"
+	case *ast.RangeStmt:
+		return "range statement"
+	case *ast.SwitchStmt, *ast.TypeSwitchStmt:
+		return "switch statement"
+	case *ast.SelectStmt:
+		return "select statement"
+	case *ast.GoStmt:
+		return "go statement"
+	case *ast.DeferStmt:
+		return "defer statement"
+	}
+	return "statement"
+}
+
+// replaceReturns replaces the return statements in the statements of src,
+// except for those of function literals, by panics.
+func replaceReturns(src string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", "package P; func F() {\n"+src+"\n}", parser.Mode(0))
+	if err != nil {
+		return "", err
+	}
+
+	body := f.Decls[0].(*ast.FuncDecl).Body
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		switch c.Node().(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			c.Replace(&ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun:  ast.NewIdent("panic"),
+					Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(enterReturnedMessage)}},
+				},
+			})
+		}
+		return true
+	}, nil)
+
+	var lines []string
+	for _, stmt := range body.List {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, stmt); err != nil {
+			return "", err
+		}
+		lines = append(lines, buf.String())
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// addFileImports adds the imports of f which src refers to.
+func (s *Session) addFileImports(f *ast.File, src string) {
+	used, err := parser.ParseFile(token.NewFileSet(), "", "package P; func F() {\n"+src+"\n}", parser.Mode(0))
+	if err != nil {
+		return
+	}
+	names := map[string]bool{}
+	ast.Inspect(used, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				names[ident.Name] = true
+			}
+		}
+		return true
+	})
+
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		var name string
+		if imp.Name != nil {
+			name = imp.Name.Name
+		} else if pkg, err := s.types.Importer.Import(path); err == nil {
+			name = pkg.Name()
+		}
+		if !names[name] {
+			continue
+		}
+		if imp.Name != nil {
+			astutil.AddNamedImport(s.fset, s.file, name, path)
+		} else {
+			astutil.AddImport(s.fset, s.file, path)
+		}
+		s.declInputs[imp.Path.Value] = s.inputNo
+	}
+}
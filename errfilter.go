@@ -3,15 +3,28 @@ package gore
 import (
 	"bytes"
 	"io"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"golang.org/x/text/transform"
 )
 
-func newErrFilter(w io.Writer) io.WriteCloser {
-	return transform.NewWriter(w, &errTransformer{})
+// newErrFilter returns a writer rewriting the error output of the compiler
+// and the program to w. The positions in the session file are rewritten into
+// those in the inputs by m if not nil; see srcmap.go.
+func newErrFilter(w io.Writer, m *sourceMap) io.WriteCloser {
+	return transform.NewWriter(w, &errTransformer{srcMap: m})
 }
 
-type errTransformer struct{}
+type errTransformer struct {
+	srcMap *sourceMap
+
+	// inTrace is set after the header of a goroutine in a stack trace,
+	// and skipLocation to drop the location of a hidden frame.
+	inTrace      bool
+	skipLocation bool
+}
 
 func (w *errTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
 	var i int
@@ -26,7 +39,7 @@ func (w *errTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int,
 				break
 			}
 		}
-		res := replaceErrMsg(src[:i+1])
+		res := w.replace(src[:i+1])
 		if nDst+len(res) > len(dst) {
 			err = transform.ErrShortDst
 			break
@@ -41,17 +54,97 @@ func (w *errTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int,
 	return
 }
 
-func (w *errTransformer) Reset() {}
+func (w *errTransformer) Reset() {
+	w.inTrace, w.skipLocation = false, false
+}
+
+var (
+	compileErrorRegexp = regexp.MustCompile(`^\S*gore_session\.go:(\d+):(\d+): `)
+	traceHeaderRegexp  = regexp.MustCompile(`^goroutine \d+ \[`)
+	traceLocRegexp     = regexp.MustCompile(`^\t\S*gore_session\.go:(\d+)(?: \+0x[0-9a-f]+)?$`)
+)
+
+// replace rewrites a line p of the error output.
+func (w *errTransformer) replace(p []byte) []byte {
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	eol := p[len(line):]
+
+	if m := compileErrorRegexp.FindSubmatch(line); m != nil {
+		l, _ := strconv.Atoi(string(m[1]))
+		c, _ := strconv.Atoi(string(m[2]))
+		if pos, ok := w.srcMap.lookup(l, c); ok {
+			return append([]byte("["+pos.String()+"] "), replaceErrMsg(p[len(m[0]):])...)
+		}
+	}
+
+	if traceHeaderRegexp.Match(line) {
+		w.inTrace = true
+	} else if w.inTrace {
+		if w.skipLocation {
+			w.skipLocation = false
+			if bytes.HasPrefix(line, []byte("\t")) {
+				return nil
+			}
+		}
+		if isHelperFrame(line) {
+			w.skipLocation = true
+			return nil
+		}
+		if m := traceLocRegexp.FindSubmatch(line); m != nil {
+			l, _ := strconv.Atoi(string(m[1]))
+			if pos, ok := w.srcMap.lookup(l, 0); ok {
+				return append([]byte("\t["+pos.String()+"]"), eol...)
+			}
+		}
+		if len(line) == 0 {
+			w.inTrace = false
+		}
+	}
+
+	return replaceErrMsg(p)
+}
+
+// isHelperFrame reports whether line is the function of a frame in a stack
+// trace, or the function which created a goroutine, which is a gore helper
+// in the session file or the helper files, or the harness of -pkg.
+func isHelperFrame(line []byte) bool {
+	if bytes.HasPrefix(line, []byte("\t")) {
+		return false
+	}
+	line = bytes.TrimPrefix(line, []byte("created by "))
+	if i := bytes.IndexAny(line, "( "); i >= 0 {
+		line = line[:i]
+	}
+	if i := bytes.LastIndexByte(line, '/'); i >= 0 {
+		line = line[i+1:]
+	}
+	// the function name without the package
+	i := bytes.IndexByte(line, '.')
+	if i < 0 {
+		return false
+	}
+	name := string(line[i+1:])
+	if name == pkgMainName || strings.HasPrefix(name, pkgMainName+".") {
+		return false
+	}
+	return strings.HasPrefix(name, "__gore_") || name == harnessName
+}
 
 func replaceErrMsg(p []byte) []byte {
 	if bytes.HasPrefix(p, []byte("# command-line-arguments")) {
 		return nil
 	}
+	if bytes.HasPrefix(p, []byte("# ")) && bytes.HasSuffix(p, []byte(".test]\n")) {
+		// "# path [path.test]" of the package of -pkg
+		return nil
+	}
 	if i := bytes.Index(p, []byte("gore_session.go")); i >= 0 {
 		if j := bytes.IndexRune(p[i:], ' '); j >= 0 {
-			return p[i+j+1:]
+			p = p[i+j+1:]
 		}
-		return p
 	}
+	p = []byte(unshadow(string(p)))
+	// "requires go1.22 or later (-lang was set to go1.21; check go.mod)"
+	p = bytes.Replace(p, []byte("; check go.mod)"), []byte("; use :set lang to change it)"), 1)
 	return p
 }
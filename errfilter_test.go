@@ -31,16 +31,76 @@ func TestErrFilter(t *testing.T) {
 			"/tmp/gore_session.go:10:24: undefined: foo",
 			"undefined: foo",
 		},
+		{
+			"language version",
+			"/tmp/gore_session.go:3:30: cannot range over 10 (untyped int constant): requires go1.22 or later (-lang was set to go1.21; check go.mod)\n",
+			"cannot range over 10 (untyped int constant): requires go1.22 or later (-lang was set to go1.21; use :set lang to change it)\n",
+		},
 		{
 			"command-line-arguments and gore_session.go",
 			"# command-line-arguments foo\n/tmp/gore_session.go:10:24: undefined: foo",
 			"undefined: foo",
 		},
+		{
+			"test package",
+			"# example.com/p [example.com/p.test]\n../gore-1/pkg/gore_session.go:10:24: undefined: foo\n",
+			"undefined: foo\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			w := newErrFilter(out, nil)
+			_, err := w.Write([]byte(tc.src))
+			require.NoError(t, err)
+			err = w.Close()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out.String())
+		})
+	}
+}
+
+func TestErrFilter_SourceMap(t *testing.T) {
+	m := &sourceMap{
+		lines: map[int][]sourceMapEntry{
+			10: {
+				{col: 2, pos: sourcePos{input: 3, line: 1, col: 1}},
+				{col: 10, pos: sourcePos{input: 3, line: 1, col: 8}},
+			},
+			20: {
+				{col: 2, pos: sourcePos{input: 1, line: 2, col: 2}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		id, src, expected string
+	}{
+		{
+			"compile error",
+			"# command-line-arguments\n./gore_session.go:10:10: undefined: foo\n./gore_session.go:10:12: undefined: __gore_bar_2\n",
+			"[in #3, col 8] undefined: foo\n[in #3, col 10] undefined: bar\n",
+		},
+		{
+			"compile error not mapped",
+			"./gore_session.go:15:3: undefined: foo\n",
+			"undefined: foo\n",
+		},
+		{
+			"panic",
+			"panic: boom\n\ngoroutine 1 [running]:\nmain.f(...)\n\t/tmp/gore-1/gore_session.go:20\nmain.main()\n\t/tmp/gore-1/gore_session.go:10 +0x1d\nexit status 2\n",
+			"panic: boom\n\ngoroutine 1 [running]:\nmain.f(...)\n\t[in #1, line 2]\nmain.main()\n\t[in #3]\nexit status 2\n",
+		},
+		{
+			"helper frames",
+			"panic: boom\n\ngoroutine 6 [running]:\nmain.T.String(...)\n\t/tmp/gore-1/gore_session.go:20\nmain.__gore_p({0xc000010000, 0x1, 0x1})\n\t/tmp/gore-1/gore_session.go:5 +0x25\np.__gore_main()\n\t/tmp/gore-1/pkg/gore_session.go:10 +0x1d\ncreated by p.Test__gore in goroutine 5\n\t/tmp/gore-1/pkg/gore_harness.go:9 +0x65\n",
+			"panic: boom\n\ngoroutine 6 [running]:\nmain.T.String(...)\n\t[in #1, line 2]\np.__gore_main()\n\t[in #3]\n",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.id, func(t *testing.T) {
 			out := new(bytes.Buffer)
-			w := newErrFilter(out)
+			w := newErrFilter(out, m)
 			_, err := w.Write([]byte(tc.src))
 			require.NoError(t, err)
 			err = w.Close()
@@ -0,0 +1,292 @@
+package gore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Eval results
+//
+// EvalContext evaluates an input like Eval for the programs embedding gore,
+// and returns what the evaluation brought in an EvalResult: the output of the
+// input, which is written to the writers of the session as well, the values
+// printed, the phase the input reached and the error.
+//
+// The values are collected by the program of the session: the calls of the
+// printer in the statements of the input are given to valuesName with their
+// numbers, which writes the values printed by the calls to a file named by
+// the environment variable GORE_VALUES. Their expressions and types are
+// taken from the type-checked session file.
+
+const valuesName = "__gore_values"
+
+const valuesSource = `package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func ` + valuesName + `(id int, unwrap bool, print func(...interface{})) func(...interface{}) {
+	return func(xx ...interface{}) {
+		values := xx
+		if unwrap {
+			if _, ok := xx[len(xx)-1].(error); ok {
+				values = nil
+			} else {
+				values = xx[:len(xx)-1]
+			}
+		}
+
+		reprs := make([]string, len(values))
+		for i, x := range values {
+			reprs[i] = fmt.Sprintf("%#v", x)
+		}
+		if f, err := os.OpenFile(os.Getenv("GORE_VALUES"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+			json.NewEncoder(f).Encode(struct {
+				ID    int      ` + "`json:\"id\"`" + `
+				Reprs []string ` + "`json:\"reprs\"`" + `
+			}{id, reprs})
+			f.Close()
+		}
+
+		print(xx...)
+	}
+}
+`
+
+// Phase is the phase of the evaluation an input reached.
+type Phase int
+
+// Phases
+const (
+	// the input was not accepted, as it is incomplete or invalid
+	PhaseParse Phase = iota
+	// the input was a command
+	PhaseCommand
+	// the program of the session was built
+	PhaseCompile
+	// the program of the session was run
+	PhaseRun
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseParse:
+		return "parse"
+	case PhaseCommand:
+		return "command"
+	case PhaseCompile:
+		return "compile"
+	case PhaseRun:
+		return "run"
+	}
+	return "Phase(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Value is a value printed by an input.
+type Value struct {
+	// Expr is the expression printed, as formatted in the session
+	Expr string
+	// Type is the type of the expression
+	Type string
+	// Repr is the value formatted by %#v
+	Repr string
+}
+
+// EvalResult is the result of an input evaluated by EvalContext.
+type EvalResult struct {
+	// Stdout and Stderr are the output of the evaluation, which is
+	// also written to the writers of the session
+	Stdout, Stderr string
+	// Values are the values printed by the input in order
+	Values []Value
+	// Phase is the phase the input reached; the input failed in the phase
+	// if Err is not nil
+	Phase    Phase
+	Duration time.Duration
+	// Err is the error which Eval returns, or the error of ctx if the run
+	// was canceled by ctx
+	Err error
+}
+
+// EvalContext evaluates the input like Eval and returns the result.
+// The run of the input is aborted when ctx is done.
+func (s *Session) EvalContext(ctx context.Context, in string) *EvalResult {
+	start := time.Now()
+	result := &EvalResult{}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	stdout, stderr := s.stdout, s.stderr
+	var outBuf, errBuf bytes.Buffer
+	s.stdout = io.MultiWriter(stdout, &outBuf)
+	s.stderr = io.MultiWriter(stderr, &errBuf)
+	s.ctx = ctx
+	s.valuesPath = filepath.Join(s.tempDir, "gore_values.json")
+	os.Remove(s.valuesPath)
+	defer func() {
+		s.stdout, s.stderr = stdout, stderr
+		s.ctx = nil
+		s.valueCalls = nil
+		os.Remove(s.valuesPath)
+		s.valuesPath = ""
+	}()
+
+	result.Err = s.Eval(in)
+	if result.Err != nil && ctx.Err() != nil {
+		result.Err = ctx.Err()
+	}
+	result.Phase = s.phase
+	result.Values = s.readValues()
+	result.Stdout = outBuf.String()
+	result.Stderr = errBuf.String()
+	result.Duration = time.Since(start)
+
+	return result
+}
+
+// context returns the context of the evaluation.
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// valueCall is a call of the printer in the latest input with
+// the expressions and the types of the values it prints.
+type valueCall struct {
+	exprs, types []string
+}
+
+// prepareValues modifies the session file for a run collecting the values
+// printed by the latest input, if EvalContext is evaluating it. It returns
+// a function to undo the changes.
+func (s *Session) prepareValues() (undo func()) {
+	s.valueCalls = nil
+	if s.valuesPath == "" {
+		return func() {}
+	}
+
+	var calls []*ast.CallExpr
+	latest := false
+	for _, stmt := range s.mainBody.List {
+		if n, ok := markerNo(stmt); ok {
+			latest = n == s.inputNo
+			continue
+		}
+		if latest && printedExprs(stmt) != nil {
+			calls = append(calls, stmt.(*ast.ExprStmt).X.(*ast.CallExpr))
+		}
+	}
+	if len(calls) == 0 {
+		return func() {}
+	}
+
+	info := types.Info{Types: map[ast.Expr]types.TypeAndValue{}}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	pkg, _ := conf.Check("main", s.fset, append(s.checkFiles(), s.file), &info)
+	qualifier := func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		return p.Name()
+	}
+
+	funs := make([]ast.Expr, len(calls))
+	for i, call := range calls {
+		unwrap := isNamedIdent(call.Fun, unwrapPrinterName)
+
+		var vc valueCall
+		for _, arg := range call.Args {
+			expr := unshadow(showNode(s.fset, arg))
+			var ts []types.Type
+			if t, ok := info.TypeOf(arg).(*types.Tuple); ok {
+				for j := 0; j < t.Len(); j++ {
+					ts = append(ts, t.At(j).Type())
+				}
+			} else {
+				ts = append(ts, info.TypeOf(arg))
+			}
+			if unwrap && len(ts) > 0 {
+				ts = ts[:len(ts)-1]
+			}
+			for _, t := range ts {
+				typ := ""
+				if t != nil {
+					typ = unshadow(types.TypeString(t, qualifier))
+				}
+				vc.exprs = append(vc.exprs, expr)
+				vc.types = append(vc.types, typ)
+			}
+		}
+		s.valueCalls = append(s.valueCalls, vc)
+
+		funs[i] = call.Fun
+		call.Fun = &ast.CallExpr{
+			Fun: ast.NewIdent(valuesName),
+			Args: []ast.Expr{
+				&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(i)},
+				ast.NewIdent(strconv.FormatBool(unwrap)),
+				funs[i],
+			},
+		}
+	}
+
+	return func() {
+		for i, call := range calls {
+			call.Fun = funs[i]
+		}
+	}
+}
+
+// readValues reads the values collected by the last run.
+func (s *Session) readValues() []Value {
+	f, err := os.Open(s.valuesPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var values []Value
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<26)
+	for sc.Scan() {
+		var rec struct {
+			ID    int      `json:"id"`
+			Reprs []string `json:"reprs"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			debugf("readValues :: err = %s", err)
+			continue
+		}
+		if rec.ID < 0 || rec.ID >= len(s.valueCalls) {
+			continue
+		}
+		vc := s.valueCalls[rec.ID]
+		for i, repr := range rec.Reprs {
+			v := Value{Repr: repr}
+			if i < len(vc.exprs) {
+				v.Expr, v.Type = vc.exprs[i], vc.types[i]
+			}
+			values = append(values, v)
+		}
+	}
+	return values
+}
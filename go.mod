@@ -1,7 +1,8 @@
 module github.com/motemen/gore
 
+go 1.22
+
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/motemen/go-quickfix v0.0.0-20160413151302-5c522febc679
 	github.com/peterh/liner v1.1.0
@@ -9,3 +10,10 @@ require (
 	golang.org/x/text v0.3.0
 	golang.org/x/tools v0.0.0-20190208222737-3744606dbb67
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
+)
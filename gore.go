@@ -2,19 +2,29 @@ package gore
 
 import (
 	"fmt"
+	"go/build"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 )
 
 type gore struct {
 	autoImport           bool
+	persist              bool
+	unwrap               bool
+	timeout              time.Duration
+	wait                 time.Duration
+	limits               string
+	lang                 string
+	module               bool
+	sessionFile          string
 	extFiles             string
 	packageName          string
+	at                   string
 	outWriter, errWriter io.Writer
 }
 
@@ -29,6 +39,14 @@ func (g *gore) run() error {
 	if err == nil {
 		// this is almost certainly unnecessary...
 		defer os.Chdir(wd)
+
+		if g.module {
+			if err := s.enterModule(wd); err != nil {
+				s.errorf("module: %s", err)
+			}
+			// the session module replaces the modules of the workspace
+			os.Setenv("GOWORK", "off")
+		}
 	}
 
 	err = os.Chdir(s.tempDir)
@@ -36,24 +54,63 @@ func (g *gore) run() error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(s.tempDir, "go.mod"), []byte("module gore_session"), 0664)
-	if err != nil {
-		return err
+	s.autoImport = g.autoImport
+	s.persist = g.persist
+	s.unwrap = g.unwrap
+	s.timeout = g.timeout
+	s.wait = g.wait
+
+	if g.lang != "" {
+		if err := s.setLang(g.lang); err != nil {
+			return fmt.Errorf("-lang: %s", err)
+		}
 	}
 
-	s.autoImport = g.autoImport
+	if g.limits != "" {
+		if err := s.limits.set(g.limits); err != nil {
+			return fmt.Errorf("-limits: %s", err)
+		}
+	}
 
 	fmt.Fprintf(g.errWriter, "gore version %s  :help for help\n", version)
 
+	if g.sessionFile != "" {
+		if err := s.load(g.sessionFile); err != nil {
+			s.errorf("-session: %s", err)
+		}
+	}
+
 	if g.extFiles != "" {
 		extFiles := strings.Split(g.extFiles, ",")
+		for i, file := range extFiles {
+			// relative to the directory gore was started in, unless an import path
+			if _, err := os.Stat(filepath.Join(wd, file)); err == nil && !filepath.IsAbs(file) {
+				extFiles[i] = filepath.Join(wd, file)
+			}
+		}
 		s.includeFiles(extFiles)
 	}
 
 	if g.packageName != "" {
-		err := s.includePackage(g.packageName)
+		path := g.packageName
+		if build.IsLocalImport(path) {
+			// relative to the directory gore was started in
+			path = filepath.Join(wd, path)
+		}
+		err := s.includePackage(path)
 		if err != nil {
-			errorf("-pkg: %s", err)
+			s.errorf("-pkg: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if g.at != "" {
+		at := g.at
+		if !filepath.IsAbs(at) {
+			// relative to the directory gore was started in
+			at = filepath.Join(wd, at)
+		}
+		if err := s.Eval(":enter " + at); err != nil {
 			os.Exit(1)
 		}
 	}
@@ -64,19 +121,19 @@ func (g *gore) run() error {
 	var historyFile string
 	home, err := homeDir()
 	if err != nil {
-		errorf("home: %s", err)
+		s.errorf("home: %s", err)
 	} else {
 		historyFile = filepath.Join(home, "history")
 
 		f, err := os.Open(historyFile)
 		if err != nil {
 			if !os.IsNotExist(err) {
-				errorf("%s", err)
+				s.errorf("%s", err)
 			}
 		} else {
 			_, err := rl.ReadHistory(f)
 			if err != nil {
-				errorf("while reading history: %s", err)
+				s.errorf("while reading history: %s", err)
 			}
 			f.Close()
 		}
@@ -110,7 +167,7 @@ func (g *gore) run() error {
 				continue
 			} else if err == ErrQuit {
 				break
-			} else if err != ErrCmdRun {
+			} else if !isRunFailure(err) {
 				rl.Clear()
 				continue
 			}
@@ -121,15 +178,15 @@ func (g *gore) run() error {
 	if historyFile != "" {
 		err := os.MkdirAll(filepath.Dir(historyFile), 0755)
 		if err != nil {
-			errorf("%s", err)
+			s.errorf("%s", err)
 		} else {
 			f, err := os.Create(historyFile)
 			if err != nil {
-				errorf("%s", err)
+				s.errorf("%s", err)
 			} else {
 				_, err := rl.WriteHistory(f)
 				if err != nil {
-					errorf("while saving history: %s", err)
+					s.errorf("while saving history: %s", err)
 				}
 				f.Close()
 			}
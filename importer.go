@@ -0,0 +1,112 @@
+package gore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/token"
+	"go/types"
+)
+
+// sessionImporter imports packages for the type checker as the session
+// module sees them, wherever gore is run: the packages are located by the
+// go command in the temporary directory of the session, so that the modules
+// required by :get and the packages copied by -context are found. The
+// packages out of GOROOT are type-checked from the source like the "source"
+// importer of go/importer does, which the standard packages are left to.
+type sessionImporter struct {
+	std      types.ImporterFrom
+	ctxt     build.Context
+	fset     *token.FileSet
+	packages map[string]*types.Package
+	// kept are the files kept at their previous versions; see keepVersion
+	kept map[string]string
+}
+
+// importing marks the packages being imported, to detect import cycles.
+var importing types.Package
+
+// newImporter returns a new importer for the type checker of the session.
+func (s *Session) newImporter() types.Importer {
+	ctxt := build.Default
+	ctxt.Dir = s.tempDir
+	return &sessionImporter{
+		std:      importer.For("source", nil).(types.ImporterFrom),
+		ctxt:     ctxt,
+		fset:     token.NewFileSet(),
+		packages: map[string]*types.Package{},
+		kept:     s.kept,
+	}
+}
+
+func (i *sessionImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, i.ctxt.Dir, 0)
+}
+
+func (i *sessionImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	// the files of the session are named relative to its directory
+	if !filepath.IsAbs(srcDir) {
+		srcDir = filepath.Join(i.ctxt.Dir, srcDir)
+	}
+	bp, err := i.ctxt.Import(path, srcDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	if bp.Goroot || bp.ImportPath == "unsafe" {
+		return i.std.ImportFrom(path, srcDir, mode)
+	}
+
+	if pkg := i.packages[bp.ImportPath]; pkg != nil {
+		if pkg == &importing {
+			return nil, fmt.Errorf("import cycle through package %q", bp.ImportPath)
+		}
+		return pkg, nil
+	}
+
+	i.packages[bp.ImportPath] = &importing
+	defer func() {
+		if i.packages[bp.ImportPath] == &importing {
+			delete(i.packages, bp.ImportPath)
+		}
+	}()
+
+	var files []*ast.File
+	names := append(append([]string{}, bp.GoFiles...), bp.CgoFiles...)
+	for _, name := range keptFiles(i.kept, bp.Dir, names) {
+		if !strings.HasSuffix(name, "_test.go") {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		f, err := parseKeptFile(i.fset, i.kept, filepath.Join(bp.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+
+	var firstHardErr error
+	conf := types.Config{
+		Importer:         i,
+		IgnoreFuncBodies: true,
+		FakeImportC:      true,
+		Error: func(err error) {
+			if err, ok := err.(types.Error); ok && !err.Soft && firstHardErr == nil {
+				firstHardErr = err
+			}
+		},
+	}
+	pkg, _ := conf.Check(bp.ImportPath, i.fset, files, nil)
+	if firstHardErr != nil {
+		return nil, fmt.Errorf("type-checking package %q failed (%v)", bp.ImportPath, firstHardErr)
+	}
+
+	i.packages[bp.ImportPath] = pkg
+	return pkg, nil
+}
@@ -0,0 +1,190 @@
+package gore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// inspected is an object of the session shown by :vars and :decls.
+type inspected struct {
+	obj   types.Object
+	no    int
+	input string
+}
+
+// inspect type-checks the session and returns the package and
+// the scope of the main function.
+func (s *Session) inspect() (*types.Package, *types.Scope, error) {
+	// positions are needed to find the inputs
+	if err := s.reset(); err != nil {
+		return nil, nil, err
+	}
+
+	info := types.Info{
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+	conf := *s.types
+	conf.Error = func(err error) {
+		debugf("typecheck error (ignored): %s", err)
+	}
+	files := s.checkFiles()
+	pkg, _ := conf.Check("main", s.fset, append(files, s.file), &info)
+	if pkg == nil {
+		return nil, nil, fmt.Errorf("could not type-check the session")
+	}
+
+	mainScope := info.Scopes[s.mainFunc().Type]
+	if mainScope == nil {
+		return nil, nil, fmt.Errorf("could not type-check the session")
+	}
+
+	return pkg, mainScope, nil
+}
+
+// inputAt returns the label of the input which the code at pos came from,
+// "#n" for inputs or the file name for files included by -context or -pkg.
+func (s *Session) inputAt(entries []entry, pos token.Pos) string {
+	if no, ok := inputNoAt(entries, pos); ok {
+		if no > 0 {
+			return fmt.Sprintf("#%d", no)
+		}
+		return "-"
+	}
+
+	if pos.IsValid() {
+		filename := s.fset.Position(pos).Filename
+		for _, path := range s.extraFilePaths {
+			if filepath.Base(path) == filepath.Base(filename) {
+				return filepath.Base(path)
+			}
+		}
+		if s.pkg != nil && filepath.Dir(filename) == s.pkg.Dir {
+			return filepath.Base(filename)
+		}
+	}
+
+	return "-"
+}
+
+// inputNoAt returns the number of the input of the entry which contains pos.
+func inputNoAt(entries []entry, pos token.Pos) (int, bool) {
+	for _, e := range entries {
+		for _, node := range e.nodes {
+			if node.Pos() <= pos && pos < node.End() {
+				return e.no, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// vars writes the variables in scope of main with their types.
+func (s *Session) vars() error {
+	pkg, mainScope, err := s.inspect()
+	if err != nil {
+		return err
+	}
+	entries := s.entries()
+
+	var objs []inspected
+	for _, scope := range []*types.Scope{mainScope, pkg.Scope()} {
+		for _, name := range scope.Names() {
+			v, ok := scope.Lookup(name).(*types.Var)
+			if !ok || name == "_" || strings.HasPrefix(name, "__gore_") {
+				// including the variables shadowed by redeclaration
+				continue
+			}
+			if scope != mainScope && mainScope.Lookup(name) != nil {
+				// shadowed
+				continue
+			}
+			no, _ := inputNoAt(entries, v.Pos())
+			objs = append(objs, inspected{obj: v, no: no, input: s.inputAt(entries, v.Pos())})
+		}
+	}
+
+	s.writeInspected(pkg, objs)
+
+	return nil
+}
+
+// decls writes the package-level functions, types and constants.
+func (s *Session) decls() error {
+	pkg, _, err := s.inspect()
+	if err != nil {
+		return err
+	}
+	entries := s.entries()
+
+	var objs []inspected
+	for _, name := range pkg.Scope().Names() {
+		obj := pkg.Scope().Lookup(name)
+		switch obj.(type) {
+		case *types.Func:
+			if name == "main" || isHelperName(name) {
+				continue
+			}
+		case *types.TypeName, *types.Const:
+		default:
+			continue
+		}
+		no, _ := inputNoAt(entries, obj.Pos())
+		objs = append(objs, inspected{obj: obj, no: no, input: s.inputAt(entries, obj.Pos())})
+
+		if named, ok := obj.Type().(*types.Named); ok {
+			if _, isTypeName := obj.(*types.TypeName); isTypeName {
+				for i := 0; i < named.NumMethods(); i++ {
+					m := named.Method(i)
+					no, _ := inputNoAt(entries, m.Pos())
+					objs = append(objs, inspected{obj: m, no: no, input: s.inputAt(entries, m.Pos())})
+				}
+			}
+		}
+	}
+
+	s.writeInspected(pkg, objs)
+
+	return nil
+}
+
+func (s *Session) writeInspected(pkg *types.Package, objs []inspected) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		if objs[i].no != objs[j].no {
+			return objs[i].no < objs[j].no
+		}
+		return objs[i].obj.Pos() < objs[j].obj.Pos()
+	})
+
+	qualifier := types.RelativeTo(pkg)
+	w := tabwriter.NewWriter(s.stdout, 0, 8, 2, ' ', 0)
+	for _, o := range objs {
+		var kind, typ string
+		name := o.obj.Name()
+		switch obj := o.obj.(type) {
+		case *types.Var:
+			kind, typ = "var", types.TypeString(obj.Type(), qualifier)
+		case *types.Func:
+			kind, typ = "func", types.TypeString(obj.Type(), qualifier)
+			sig := obj.Type().(*types.Signature)
+			if recv := sig.Recv(); recv != nil {
+				// methods are shown as "(T).M" or "(*T).M" with the signature without the receiver
+				kind = "method"
+				name = fmt.Sprintf("(%s).%s", types.TypeString(recv.Type(), qualifier), name)
+				typ = types.TypeString(types.NewSignatureType(nil, nil, nil, sig.Params(), sig.Results(), sig.Variadic()), qualifier)
+			}
+		case *types.TypeName:
+			kind, typ = "type", types.TypeString(obj.Type().Underlying(), qualifier)
+		case *types.Const:
+			kind, typ = "const", fmt.Sprintf("%s = %s", types.TypeString(obj.Type(), qualifier), obj.Val())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.input, kind, name, typ)
+	}
+	w.Flush()
+}
@@ -0,0 +1,282 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limits are resource limits applied to the evaluated program.
+// They are set by setrlimit(2) in the limiter, which then execs the program,
+// so that they apply from its start, including the initialization of its
+// packages, but not to the compiler. Zero means no limit.
+//
+// RLIMIT_NPROC, the limit of procs, counts all the processes and the threads
+// of the user, not only those of the program.
+type limits struct {
+	memory uint64
+	cpu    time.Duration
+	files  uint64
+	procs  uint64
+}
+
+// set updates the limits by a list of key=value separated by commas or spaces,
+// e.g. "mem=512M,cpu=10s". A value of "off" (or 0) removes the limit.
+// "off" alone removes all the limits.
+func (l *limits) set(arg string) error {
+	if !rlimitSupported {
+		return fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+	}
+
+	if strings.TrimSpace(arg) == "off" {
+		*l = limits{}
+		return nil
+	}
+
+	n := *l
+	for _, kv := range strings.FieldsFunc(arg, func(c rune) bool { return c == ',' || c == ' ' }) {
+		p := strings.IndexByte(kv, '=')
+		if p < 0 {
+			return fmt.Errorf("invalid limit: %s", kv)
+		}
+		key, value := kv[:p], kv[p+1:]
+		if value == "off" {
+			value = "0"
+		}
+
+		var err error
+		switch key {
+		case "mem":
+			n.memory, err = parseSize(value)
+		case "cpu":
+			if value == "0" {
+				n.cpu = 0
+			} else {
+				n.cpu, err = time.ParseDuration(value)
+				if err == nil && n.cpu < time.Second {
+					err = fmt.Errorf("must be at least 1s")
+				}
+			}
+		case "files":
+			n.files, err = strconv.ParseUint(value, 10, 64)
+		case "procs":
+			n.procs, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return fmt.Errorf("unknown limit: %s (must be one of mem, cpu, files, procs)", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid limit: %s: %s", kv, err)
+		}
+	}
+	*l = n
+
+	return nil
+}
+
+func (l limits) String() string {
+	format := func(v uint64, s string) string {
+		if v == 0 {
+			return "off"
+		}
+		return s
+	}
+	return fmt.Sprintf(
+		"mem=%s cpu=%s files=%s procs=%s",
+		format(l.memory, formatSize(l.memory)),
+		format(uint64(l.cpu), l.cpu.String()),
+		format(l.files, strconv.FormatUint(l.files, 10)),
+		format(l.procs, strconv.FormatUint(l.procs, 10)),
+	)
+}
+
+// rlimits returns the resources and the values to set by setrlimit(2).
+func (l limits) rlimits() [][2]uint64 {
+	var rlimits [][2]uint64
+	if l.memory > 0 {
+		rlimits = append(rlimits, [2]uint64{rlimitData, l.memory})
+	}
+	if l.cpu > 0 {
+		rlimits = append(rlimits, [2]uint64{rlimitCPU, uint64(l.rlimitCPU() / time.Second)})
+	}
+	if l.files > 0 {
+		rlimits = append(rlimits, [2]uint64{rlimitNofile, l.files})
+	}
+	if l.procs > 0 {
+		rlimits = append(rlimits, [2]uint64{rlimitNproc, l.procs})
+	}
+	return rlimits
+}
+
+// limiterSource is the program which sets the limits given as arguments
+// like "<resource>=<value>" and then execs the command after "--".
+const limiterSource = `package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	args := os.Args[1:]
+	for ; len(args) > 0 && args[0] != "--"; args = args[1:] {
+		kv := strings.SplitN(args[0], "=", 2)
+		resource, _ := strconv.Atoi(kv[0])
+		value, _ := strconv.ParseUint(kv[1], 10, 64)
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			os.Stderr.WriteString("gore: setrlimit: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+	}
+	err := syscall.Exec(args[1], args[1:], os.Environ())
+	os.Stderr.WriteString("gore: exec: " + err.Error() + "\n")
+	os.Exit(1)
+}
+`
+
+// limit makes cmd run under the limits of the session by the limiter,
+// which is built into the session directory at first.
+func (s *Session) limit(cmd *exec.Cmd) error {
+	rlimits := s.limits.rlimits()
+	if len(rlimits) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(s.tempDir, "gore_limiter")
+	limiter := filepath.Join(dir, "gore_limiter")
+	if _, err := os.Stat(limiter); err != nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(limiterSource), 0644); err != nil {
+			return err
+		}
+		build := exec.Command("go", "build", "-o", limiter, filepath.Join(dir, "main.go"))
+		build.Dir = s.tempDir
+		if out, err := build.CombinedOutput(); err != nil {
+			return fmt.Errorf("building the limiter: %s\n%s", err, out)
+		}
+	}
+
+	args := []string{limiter}
+	for _, r := range rlimits {
+		args = append(args, fmt.Sprintf("%d=%d", r[0], r[1]))
+	}
+	cmd.Args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path = limiter
+
+	return nil
+}
+
+// rlimitCPU returns the CPU time limit rounded up to seconds as set.
+func (l limits) rlimitCPU() time.Duration {
+	return (l.cpu + time.Second - 1) / time.Second * time.Second
+}
+
+// cpuTime returns the CPU time the exited process used, which is accounted
+// less precisely than the limit is checked.
+func cpuTime(state *os.ProcessState) time.Duration {
+	if state == nil {
+		return 0
+	}
+	return state.UserTime() + state.SystemTime()
+}
+
+// exceeded guesses which limit killed the program from its error output
+// and the state of the exited process.
+func (l limits) exceeded(stderr []byte, state *os.ProcessState) string {
+	contains := func(patterns ...string) bool {
+		for _, p := range patterns {
+			if bytes.Contains(stderr, []byte(p)) {
+				return true
+			}
+		}
+		return false
+	}
+	// EAGAIN tells the process limit only from fork(2), not from reads or writes
+	forkFailed := func() bool {
+		for _, line := range bytes.Split(stderr, []byte("\n")) {
+			if bytes.Contains(line, []byte("fork/exec ")) && bytes.Contains(line, []byte("resource temporarily unavailable")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case l.memory > 0 && contains("runtime: out of memory", "cannot allocate memory"):
+		return fmt.Sprintf("memory limit (%s) exceeded", formatSize(l.memory))
+	case l.cpu > 0 && killedByCPULimit(state) && cpuTime(state) >= l.rlimitCPU()*9/10:
+		return fmt.Sprintf("CPU time limit (%s) exceeded", l.cpu)
+	case l.files > 0 && contains("too many open files"):
+		return fmt.Sprintf("open file limit (%d) exceeded", l.files)
+	case l.procs > 0 && (contains("failed to create new OS thread", "pthread_create failed") || forkFailed()):
+		return fmt.Sprintf("process limit (%d, counting all the processes of the user) exceeded", l.procs)
+	}
+
+	return ""
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses sizes like "512M" or "1G"; units are powers of 1024.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(s, u.suffix), 10, 64)
+			return n * u.size, err
+		}
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func formatSize(n uint64) string {
+	for _, u := range sizeUnits {
+		if n >= u.size && n%u.size == 0 {
+			return fmt.Sprintf("%d%s", n/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// sampleWriter keeps the first and the last bytes written to it,
+// where the messages of fatal errors and the exit status appear.
+type sampleWriter struct {
+	head, tail []byte
+}
+
+const sampleSize = 4096
+
+func (w *sampleWriter) Write(p []byte) (int, error) {
+	if n := sampleSize - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > sampleSize {
+		w.tail = w.tail[len(w.tail)-sampleSize:]
+	}
+	return len(p), nil
+}
+
+func (w *sampleWriter) Bytes() []byte {
+	return append(append([]byte{}, w.head...), w.tail...)
+}
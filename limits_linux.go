@@ -0,0 +1,32 @@
+package gore
+
+import (
+	"os"
+	"syscall"
+)
+
+const rlimitSupported = true
+
+// RLIMIT_DATA is used for the memory limit rather than RLIMIT_AS
+// because the Go runtime reserves a large address space in advance.
+const (
+	rlimitData   = syscall.RLIMIT_DATA
+	rlimitCPU    = syscall.RLIMIT_CPU
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitNproc  = 0x6 // not defined in package syscall
+)
+
+// killedByCPULimit reports whether the process was killed by the signals
+// sent on exceeding RLIMIT_CPU; SIGKILL is sent at the hard limit, which
+// is the same as the soft one. As SIGKILL is sent by the OOM killer or
+// kill -9 as well, the CPU time used is to be checked too.
+func killedByCPULimit(state *os.ProcessState) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	return status.Signal() == syscall.SIGKILL || status.Signal() == syscall.SIGXCPU
+}
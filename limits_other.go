@@ -0,0 +1,18 @@
+//go:build !linux
+
+package gore
+
+import "os"
+
+const rlimitSupported = false
+
+const (
+	rlimitData = iota
+	rlimitCPU
+	rlimitNofile
+	rlimitNproc
+)
+
+func killedByCPULimit(state *os.ProcessState) bool {
+	return false
+}
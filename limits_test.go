@@ -0,0 +1,96 @@
+package gore
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits_set(t *testing.T) {
+	if !rlimitSupported {
+		t.Skipf("resource limits unsupported on %s", runtime.GOOS)
+	}
+
+	var l limits
+	assert.Equal(t, "mem=off cpu=off files=off procs=off", l.String())
+	assert.Empty(t, l.rlimits())
+
+	require.NoError(t, l.set("mem=512M,cpu=10s"))
+	assert.Equal(t, limits{memory: 512 << 20, cpu: 10 * time.Second}, l)
+
+	require.NoError(t, l.set("files=256 procs=64 mem=1g"))
+	assert.Equal(t, "mem=1G cpu=10s files=256 procs=64", l.String())
+	assert.Len(t, l.rlimits(), 4)
+
+	require.NoError(t, l.set("cpu=off"))
+	assert.Equal(t, "mem=1G cpu=off files=256 procs=64", l.String())
+
+	require.NoError(t, l.set("off"))
+	assert.Equal(t, limits{}, l)
+
+	assert.Error(t, l.set("mem"))
+	assert.Error(t, l.set("disk=1G"))
+	assert.Error(t, l.set("mem=lots"))
+	assert.Error(t, l.set("cpu=10ms"))
+}
+
+func TestSessionEval_Limits(t *testing.T) {
+	if !rlimitSupported {
+		t.Skipf("resource limits unsupported on %s", runtime.GOOS)
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	err = s.Eval(":limits mem=64M")
+	require.NoError(t, err)
+
+	err = s.Eval("len(make([]byte, 1<<30))")
+	require.Equal(t, ErrCmdRun, err)
+
+	err = s.Eval("1")
+	require.NoError(t, err)
+
+	err = s.Eval(":limits mem=off cpu=1s")
+	require.NoError(t, err)
+
+	err = s.Eval("for {}")
+	require.Equal(t, ErrCmdRun, err)
+
+	err = s.Eval("2")
+	require.NoError(t, err)
+
+	// the limits apply to the initialization of the package variables too
+	err = s.Eval(":define var spun = func() int { for {} }()")
+	require.NoError(t, err)
+
+	err = s.Eval("spun")
+	require.Equal(t, ErrCmdRun, err)
+
+	assert.Equal(t, "1\n2\n", stdout.String())
+	assert.Contains(t, stderr.String(), "memory limit (64M) exceeded while running input #1\n")
+	assert.Contains(t, stderr.String(), "CPU time limit (1s) exceeded while running input #3\n")
+	assert.Contains(t, stderr.String(), "CPU time limit (1s) exceeded while initializing the program\n")
+}
+
+func TestLimits_exceeded_killed(t *testing.T) {
+	if !rlimitSupported {
+		t.Skipf("resource limits unsupported on %s", runtime.GOOS)
+	}
+
+	// killed by SIGKILL before using up the CPU time, as by kill -9
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+
+	l := limits{cpu: time.Second}
+	assert.Equal(t, "", l.exceeded(nil, cmd.ProcessState))
+}
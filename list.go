@@ -0,0 +1,402 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"go/types"
+)
+
+// entry is a part of the session code which came from one input:
+// a group of statements in main, a package-level declaration or an import.
+type entry struct {
+	no    int // the number of the input, or 0 if unknown
+	names []string
+	nodes []ast.Node
+}
+
+// declKey returns the key of a function declaration in declInputs,
+// which is the name of the function, or "T.M" for a method M of type T
+// whether the receiver is a pointer or not.
+func declKey(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	return recvTypeName(decl.Recv.List[0].Type) + "." + decl.Name.Name
+}
+
+// recvTypeName returns the name of the receiver type such as T, *T or T[P].
+func recvTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e.Name
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		default:
+			return "?"
+		}
+	}
+}
+
+// declKeys returns the keys of the names declared by decl in declInputs.
+// Imports are keyed by their quoted paths.
+func declKeys(decl ast.Decl) []string {
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		return []string{declKey(decl)}
+	case *ast.GenDecl:
+		var keys []string
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.ImportSpec:
+				keys = append(keys, spec.Path.Value)
+			case *ast.TypeSpec:
+				keys = append(keys, spec.Name.Name)
+			case *ast.ValueSpec:
+				for _, name := range spec.Names {
+					keys = append(keys, name.Name)
+				}
+			}
+		}
+		return keys
+	}
+	return nil
+}
+
+// recordImports numbers the imports added by fixImports with the current input,
+// which are those not in lastImports stored before it.
+func (s *Session) recordImports() {
+imports:
+	for _, imp := range s.file.Imports {
+		if _, ok := s.declInputs[imp.Path.Value]; ok {
+			continue
+		}
+		for _, last := range s.lastImports {
+			if last.Path.Value == imp.Path.Value {
+				continue imports
+			}
+		}
+		s.declInputs[imp.Path.Value] = s.inputNo
+	}
+}
+
+// entries returns the entries of the session ordered by their input numbers.
+func (s *Session) entries() []entry {
+	var entries []entry
+
+	for _, decl := range s.file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl == s.mainFunc() || isHelperName(decl.Name.Name) {
+				continue
+			}
+			key := declKey(decl)
+			entries = append(entries, entry{no: s.declInputs[key], names: []string{key}, nodes: []ast.Node{decl}})
+
+		case *ast.GenDecl:
+			if decl.Tok != token.IMPORT {
+				keys := declKeys(decl)
+				e := entry{names: keys, nodes: []ast.Node{decl}}
+				if len(keys) > 0 {
+					e.no = s.declInputs[keys[0]]
+				}
+				entries = append(entries, e)
+				continue
+			}
+
+			for _, spec := range decl.Specs {
+				imp := spec.(*ast.ImportSpec)
+				path, _ := strconv.Unquote(imp.Path.Value)
+				no, ok := s.declInputs[imp.Path.Value]
+				if !ok {
+					// imported by the initial source
+					continue
+				}
+				names := []string{path}
+				if imp.Name != nil && imp.Name.Name != "_" && imp.Name.Name != "." {
+					names = append(names, imp.Name.Name)
+				} else if i := strings.LastIndex(path, "/"); i >= 0 {
+					names = append(names, path[i+1:])
+				}
+				entries = append(entries, entry{no: no, names: names, nodes: []ast.Node{imp}})
+			}
+		}
+	}
+
+	var group *entry
+	for _, stmt := range s.mainBody.List {
+		if n, ok := markerNo(stmt); ok || group == nil {
+			entries = append(entries, entry{no: n})
+			group = &entries[len(entries)-1]
+		}
+		group.nodes = append(group.nodes, stmt)
+		group.names = append(group.names, definedNames(stmt)...)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].no < entries[j].no
+	})
+
+	return entries
+}
+
+// definedNames returns the names a statement in main declares.
+func definedNames(stmt ast.Stmt) []string {
+	var names []string
+	switch stmt := stmt.(type) {
+	case *ast.AssignStmt:
+		if stmt.Tok == token.DEFINE {
+			for _, lhs := range stmt.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok && ident.Name != "_" {
+					names = append(names, ident.Name)
+				}
+			}
+		}
+	case *ast.DeclStmt:
+		names = declKeys(stmt.Decl)
+	}
+	return names
+}
+
+// code returns the source of the entry as entered, without
+// markers and the printing calls added by gore.
+func (s *Session) code(e entry) string {
+	config := &printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}
+
+	var lines []string
+	for _, node := range e.nodes {
+		var buf bytes.Buffer
+		switch node := node.(type) {
+		case *ast.ImportSpec:
+			buf.WriteString("import ")
+			config.Fprint(&buf, s.fset, node)
+		case ast.Stmt:
+			if _, ok := markerNo(node); ok {
+				continue
+			}
+			exprs := printedExprs(node)
+			if assign, ok := node.(*ast.AssignStmt); ok && len(assign.Rhs) == 1 {
+				// "_ = f()" converted from "__gore_p(f())" by clearQuickFix
+				blank := true
+				for _, lhs := range assign.Lhs {
+					blank = blank && isNamedIdent(lhs, "_")
+				}
+				if blank {
+					exprs = assign.Rhs
+				}
+			}
+			if exprs != nil {
+				for i, expr := range exprs {
+					if i > 0 {
+						buf.WriteString(", ")
+					}
+					config.Fprint(&buf, s.fset, expr)
+				}
+				break
+			}
+			config.Fprint(&buf, s.fset, node)
+		default:
+			config.Fprint(&buf, s.fset, node)
+		}
+		lines = append(lines, unshadow(buf.String()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// list writes the entries of the session with their input numbers.
+func (s *Session) list() {
+	for _, e := range s.entries() {
+		code := s.code(e)
+		if code == "" {
+			continue
+		}
+
+		label := "-"
+		if e.no > 0 {
+			label = fmt.Sprintf("#%d", e.no)
+		}
+		code = strings.Replace(code, "\n", "\n      ", -1)
+		fmt.Fprintf(s.stdout, "%5s %s\n", label, code)
+	}
+}
+
+// remove removes the input numbered n, or the input which declared
+// the name given as target, from the session. Unless force is true,
+// the code is not changed if it breaks other entries.
+func (s *Session) remove(target string, force bool) error {
+	// positions are needed to locate errors
+	if err := s.reset(); err != nil {
+		return err
+	}
+
+	entries := s.entries()
+
+	var removed []entry
+	no, err := strconv.Atoi(strings.TrimPrefix(target, "#"))
+	if err == nil {
+		for _, e := range entries {
+			if e.no == no {
+				removed = append(removed, e)
+			}
+		}
+	} else {
+		no = -1
+	find:
+		for i := len(entries) - 1; i >= 0; i-- {
+			for _, name := range entries[i].names {
+				if name == target {
+					no = entries[i].no
+					if no == 0 {
+						removed = append(removed, entries[i])
+					}
+					break find
+				}
+			}
+		}
+		if no > 0 {
+			for _, e := range entries {
+				if e.no == no {
+					removed = append(removed, e)
+				}
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("no such input or declaration: %s", target)
+	}
+
+	drop := map[ast.Node]bool{}
+	for _, e := range removed {
+		for _, node := range e.nodes {
+			if imp, ok := node.(*ast.ImportSpec); ok && imp.Name == nil && s.initialImports[imp.Path.Value] {
+				// only the input is removed
+				continue
+			}
+			drop[node] = true
+		}
+	}
+
+	decls, stmts := s.without(drop)
+	if broken := s.brokenEntries(entries, decls, stmts); len(broken) > 0 {
+		if !force {
+			return fmt.Errorf("would break other inputs (use -f to remove anyway):\n%s", strings.Join(broken, "\n"))
+		}
+		for _, b := range broken {
+			s.errorf("%s", b)
+		}
+	}
+
+	s.file.Decls = decls
+	s.mainBody.List = stmts
+	for key, n := range s.declInputs {
+		if n == no {
+			delete(s.declInputs, key)
+		}
+	}
+	if no > 0 {
+		inputs := s.inputs[:0:0]
+		for _, in := range s.inputs {
+			if in.no != no {
+				inputs = append(inputs, in)
+			}
+		}
+		s.inputs = inputs
+	}
+
+	// the saved state may contain the effects of the removed input
+	s.statePath = ""
+
+	return s.doQuickFix()
+}
+
+// without returns the declarations and the statements of the session
+// without the nodes in drop.
+func (s *Session) without(drop map[ast.Node]bool) (decls []ast.Decl, stmts []ast.Stmt) {
+	for _, stmt := range s.mainBody.List {
+		if !drop[stmt] {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	for _, decl := range s.file.Decls {
+		if drop[decl] {
+			continue
+		}
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			g := *gen
+			g.Specs = nil
+			for _, spec := range gen.Specs {
+				if !drop[spec] {
+					g.Specs = append(g.Specs, spec)
+				}
+			}
+			if len(g.Specs) == 0 {
+				continue
+			}
+			decl = &g
+		}
+		decls = append(decls, decl)
+	}
+
+	return decls, stmts
+}
+
+// brokenEntries type-checks the session with decls and stmts and returns
+// the errors which the current code does not have, with the numbers of
+// the inputs where they occur.
+func (s *Session) brokenEntries(entries []entry, decls []ast.Decl, stmts []ast.Stmt) []string {
+	before := map[string]bool{}
+	for _, err := range s.typeErrors(s.file.Decls, s.mainBody.List) {
+		before[err.Msg] = true
+	}
+
+	var broken []string
+	for _, err := range s.typeErrors(decls, stmts) {
+		if before[err.Msg] {
+			continue
+		}
+		broken = append(broken, fmt.Sprintf("%5s %s", s.inputAt(entries, err.Pos), err.Msg))
+	}
+
+	return broken
+}
+
+// typeErrors type-checks the session with decls and stmts, ignoring
+// unused variables and imports which quickfix takes care of.
+func (s *Session) typeErrors(decls []ast.Decl, stmts []ast.Stmt) []types.Error {
+	file := *s.file
+	file.Decls = make([]ast.Decl, len(decls))
+	for i, decl := range decls {
+		if decl == s.mainFunc() {
+			main := *s.mainFunc()
+			main.Body = &ast.BlockStmt{Lbrace: main.Body.Lbrace, List: stmts, Rbrace: main.Body.Rbrace}
+			decl = &main
+		}
+		file.Decls[i] = decl
+	}
+
+	var errs []types.Error
+	conf := *s.types
+	conf.Error = func(err error) {
+		if err, ok := err.(types.Error); ok && !strings.Contains(err.Msg, " not used") {
+			errs = append(errs, err)
+		}
+	}
+	files := s.checkFiles()
+	conf.Check("main", s.fset, append(files, &file), nil)
+
+	return errs
+}
@@ -2,13 +2,12 @@ package gore
 
 import (
 	"fmt"
-	"os"
 )
 
-func errorf(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+func (s *Session) errorf(format string, args ...interface{}) {
+	fmt.Fprintf(s.stderr, "error: "+format+"\n", args...)
 }
 
-func infof(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", args...)
+func (s *Session) infof(format string, args ...interface{}) {
+	fmt.Fprintf(s.stderr, format+"\n", args...)
 }
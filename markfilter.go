@@ -0,0 +1,112 @@
+package gore
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// markPrefix begins a mark written by the marker function
+// of the session (see initialSourceTemplate); a mark has
+// the form "\x00gore:N\x00" where N is the input number.
+const markPrefix = "\x00gore:"
+
+// markFilter is a writer which strips marks from the output of the session
+// and passes through only the output of inputs numbered since or later.
+// The output before the first mark (e.g. compile errors) is always passed.
+type markFilter struct {
+	w       io.Writer
+	since   int
+	current int
+	pending []byte
+}
+
+func newMarkFilter(w io.Writer, since int) *markFilter {
+	return &markFilter{w: w, since: since, current: -1}
+}
+
+func (f *markFilter) showing() bool {
+	return f.current < 0 || f.current >= f.since
+}
+
+func (f *markFilter) Write(p []byte) (int, error) {
+	f.pending = append(f.pending, p...)
+
+	for len(f.pending) > 0 {
+		i := bytes.IndexByte(f.pending, '\x00')
+		if i < 0 {
+			i = len(f.pending)
+		}
+		if err := f.emit(f.pending[:i]); err != nil {
+			return 0, err
+		}
+		f.pending = f.pending[i:]
+		if len(f.pending) == 0 {
+			break
+		}
+
+		n, size := parseMark(f.pending)
+		if size == 0 {
+			// may be an incomplete mark; wait for more
+			break
+		}
+		if n < 0 {
+			// not a mark
+			if err := f.emit(f.pending[:size]); err != nil {
+				return 0, err
+			}
+		} else {
+			f.current = n
+		}
+		f.pending = f.pending[size:]
+	}
+
+	return len(p), nil
+}
+
+func (f *markFilter) emit(p []byte) error {
+	if len(p) == 0 || !f.showing() {
+		return nil
+	}
+	_, err := f.w.Write(p)
+	return err
+}
+
+// Close flushes the pending output.
+func (f *markFilter) Close() error {
+	err := f.emit(f.pending)
+	f.pending = nil
+	return err
+}
+
+// parseMark parses a mark at the beginning of p, which starts with "\x00".
+// It returns the input number and the size of the mark, or n = -1 and size = 1
+// if p does not start with a mark. size = 0 means p is too short to decide.
+func parseMark(p []byte) (n int, size int) {
+	prefix := []byte(markPrefix)
+	if len(p) < len(prefix) {
+		if bytes.HasPrefix(prefix, p) {
+			return 0, 0
+		}
+		return -1, 1
+	}
+	if !bytes.HasPrefix(p, prefix) {
+		return -1, 1
+	}
+
+	for i := len(prefix); i < len(p); i++ {
+		c := p[i]
+		if c == '\x00' {
+			n, err := strconv.Atoi(string(p[len(prefix):i]))
+			if err != nil {
+				return -1, 1
+			}
+			return n, i + 1
+		}
+		if c < '0' || c > '9' {
+			return -1, 1
+		}
+	}
+
+	return 0, 0
+}
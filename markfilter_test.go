@@ -0,0 +1,61 @@
+package gore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkFilter(t *testing.T) {
+	testCases := []struct {
+		id     string
+		since  int
+		src    []string
+		expect string
+	}{
+		{
+			"no marks",
+			2,
+			[]string{"foo\n", "bar"},
+			"foo\nbar",
+		},
+		{
+			"latest input",
+			2,
+			[]string{"init\n\x00gore:1\x00a\n\x00gore:2\x00b\n"},
+			"init\nb\n",
+		},
+		{
+			"all inputs",
+			0,
+			[]string{"\x00gore:1\x00a\n\x00gore:2\x00b\n"},
+			"a\nb\n",
+		},
+		{
+			"split mark",
+			2,
+			[]string{"\x00gore:1\x00a\x00go", "re:", "2\x00b"},
+			"b",
+		},
+		{
+			"not a mark",
+			0,
+			[]string{"a\x00b\x00gore:x\x00", "\x00go"},
+			"a\x00b\x00gore:x\x00\x00go",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			w := newMarkFilter(out, tc.since)
+			for _, src := range tc.src {
+				_, err := w.Write([]byte(src))
+				require.NoError(t, err)
+			}
+			err := w.Close()
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, out.String())
+		})
+	}
+}
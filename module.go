@@ -0,0 +1,442 @@
+package gore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	goversion "go/version"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The session is run in a module of its own, whose go.mod is written
+// in the temporary directory of the session. The go directive of go.mod
+// decides the language version of the session, which is also given to
+// the type checker so that both agree on the language features.
+//
+// Modules required by the session are added by :get, which runs "go get"
+// in the session module, so that the go command resolves them as usual
+// (from the module cache, GOPROXY, honoring GOFLAGS and GOPROXY=off).
+//
+// When gore is started inside a module or a go.work workspace, the session
+// module requires the modules of the working tree and replaces them with
+// their directories, so that their packages are imported as they are on
+// the disk. The session module is named under the module of the current
+// directory, so that its internal packages can be imported too.
+
+// requirement is a module required by the session module.
+type requirement struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+// hostModule is a module of the working tree which the session is run in.
+type hostModule struct {
+	Path string
+	Dir  string
+}
+
+// replacement is a replace directive of go.mod or go.work.
+type replacement struct {
+	Old, New struct {
+		Path    string
+		Version string
+	}
+}
+
+// modFile is the output of "go mod edit -json" and "go work edit -json".
+type modFile struct {
+	Module struct {
+		Path string
+	}
+	Go      string
+	Require []requirement
+	Replace []replacement
+	Use     []struct {
+		DiskPath string
+	}
+}
+
+// hostModuleVersion is the version of host modules required by the session,
+// which does not matter as they are replaced.
+const hostModuleVersion = "v0.0.0-00010101000000-000000000000"
+
+var (
+	toolchainVersionOnce sync.Once
+	toolchainVersion     string
+)
+
+// goToolchainVersion returns the version of the installed go command,
+// such as "go1.22.1", or the version gore was built with if it is unknown.
+func goToolchainVersion() string {
+	toolchainVersionOnce.Do(func() {
+		out, err := exec.Command("go", "env", "GOVERSION").Output()
+		if v := strings.TrimSpace(string(out)); err == nil && goversion.IsValid(v) {
+			toolchainVersion = v
+			return
+		}
+		debugf("go env GOVERSION: %s", err)
+		toolchainVersion = runtime.Version()
+	})
+	return toolchainVersion
+}
+
+// defaultLang returns the language version of the installed toolchain,
+// or "" if it is unknown (e.g. development versions).
+func defaultLang() string {
+	return goversion.Lang(goToolchainVersion())
+}
+
+// setLang sets the language version of the session, e.g. "go1.21".
+// An empty lang resets it to the version of the toolchain.
+func (s *Session) setLang(lang string) error {
+	if lang == "" {
+		lang = defaultLang()
+	} else if !strings.HasPrefix(lang, "go") {
+		lang = "go" + lang
+	}
+	if lang != "" && (!goversion.IsValid(lang) || goversion.Lang(lang) != lang) {
+		return fmt.Errorf("invalid language version: %s (must be like go1.21)", lang)
+	}
+	if toolchain := goToolchainVersion(); lang != "" && goversion.IsValid(toolchain) && goversion.Compare(lang, goversion.Lang(toolchain)) > 0 {
+		return fmt.Errorf("%s is newer than the go toolchain (%s)", lang, toolchain)
+	}
+
+	s.lang = lang
+	s.types.GoVersion = lang
+
+	return s.writeGoMod()
+}
+
+// goMod returns the content of go.mod of the session module.
+func (s *Session) goMod() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "module %s\n", s.modulePath())
+	if s.lang != "" {
+		fmt.Fprintf(&buf, "\ngo %s\n", strings.TrimPrefix(s.lang, "go"))
+	}
+	if requires := s.allRequires(); len(requires) > 0 || len(s.hostModules) > 0 {
+		fmt.Fprintf(&buf, "\nrequire (\n")
+		for _, m := range s.hostModules {
+			fmt.Fprintf(&buf, "\t%s %s\n", m.Path, hostModuleVersion)
+		}
+		for _, r := range requires {
+			fmt.Fprintf(&buf, "\t%s %s", r.Path, r.Version)
+			if r.Indirect {
+				fmt.Fprintf(&buf, " // indirect")
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		fmt.Fprintf(&buf, ")\n")
+	}
+	if len(s.replaces) > 0 || len(s.hostModules) > 0 {
+		fmt.Fprintf(&buf, "\nreplace (\n")
+		for _, m := range s.hostModules {
+			fmt.Fprintf(&buf, "\t%s => %s\n", m.Path, m.Dir)
+		}
+		for _, r := range s.replaces {
+			fmt.Fprintf(&buf, "\t%s => %s\n", modVersion(r.Old.Path, r.Old.Version), modVersion(r.New.Path, r.New.Version))
+		}
+		fmt.Fprintf(&buf, ")\n")
+	}
+	return buf.Bytes()
+}
+
+// allRequires returns the requirements added by :get and those of the host
+// modules which :get has not changed.
+func (s *Session) allRequires() []requirement {
+	requires := append([]requirement{}, s.requires...)
+	for _, hr := range s.hostRequires {
+		found := false
+		for _, r := range s.requires {
+			found = found || r.Path == hr.Path
+		}
+		if !found {
+			requires = append(requires, hr)
+		}
+	}
+	return requires
+}
+
+// writeGoMod writes go.mod of the session module.
+func (s *Session) writeGoMod() error {
+	return ioutil.WriteFile(filepath.Join(s.tempDir, "go.mod"), s.goMod(), 0644)
+}
+
+// getModule adds a requirement of the module specified by arg,
+// which is of the form "path[@version]", to the session module.
+func (s *Session) getModule(arg string) error {
+	cmd := exec.Command("go", "get", arg)
+	cmd.Dir = s.tempDir
+	cmd.Stdout = s.stdout
+	cmd.Stderr = s.stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	// the packages imported so far may be of other versions
+	s.types.Importer = s.newImporter()
+
+	return s.readGoMod()
+}
+
+// readGoMod reads go.mod of the session module updated by the go command.
+func (s *Session) readGoMod() error {
+	cmd := exec.Command("go", "mod", "edit", "-json")
+	cmd.Dir = s.tempDir
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	var mod modFile
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return err
+	}
+
+	s.requires = nil
+	for _, r := range mod.Require {
+		if !s.isHostModule(r.Path) && !s.isHostRequire(r) {
+			s.requires = append(s.requires, r)
+		}
+	}
+
+	// the go directive is raised when a module requires a newer version
+	if lang := goversion.Lang("go" + mod.Go); lang != "" && goversion.Compare(lang, s.lang) > 0 {
+		s.infof("language version raised to %s", lang)
+		s.lang = lang
+		s.types.GoVersion = lang
+	}
+
+	return nil
+}
+
+// modVersion formats a module path with an optional version as in go.mod.
+func modVersion(path, version string) string {
+	if version == "" {
+		return path
+	}
+	return path + " " + version
+}
+
+// modulePath returns the module path of the session module.
+func (s *Session) modulePath() string {
+	if s.mainModule != "" {
+		return s.mainModule + "/gore_session"
+	}
+	return "gore_session"
+}
+
+func (s *Session) isHostModule(path string) bool {
+	for _, m := range s.hostModules {
+		if m.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostRequire reports whether r is a requirement of the host modules
+// which :get has not changed.
+func (s *Session) isHostRequire(r requirement) bool {
+	for _, hr := range s.hostRequires {
+		if hr.Path == r.Path && hr.Version == r.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// enterModule makes the session run inside the module or the workspace
+// which contains dir, if any.
+func (s *Session) enterModule(dir string) error {
+	out, err := goEnv(dir, "GOWORK", "GOMOD")
+	if err != nil {
+		return err
+	}
+	gowork, gomod := out[0], out[1]
+
+	var (
+		modDirs  []string
+		replaces []replacement
+		sumFiles []string
+	)
+	if gowork != "" && gowork != "off" {
+		work, err := readModFile(filepath.Dir(gowork), "work", gowork)
+		if err != nil {
+			return err
+		}
+		for _, use := range work.Use {
+			modDirs = append(modDirs, absDir(filepath.Dir(gowork), use.DiskPath))
+		}
+		replaces = append(replaces, absReplaces(filepath.Dir(gowork), work.Replace)...)
+		sumFiles = append(sumFiles, filepath.Join(filepath.Dir(gowork), "go.work.sum"))
+	} else if gomod != "" && gomod != os.DevNull {
+		modDirs = append(modDirs, filepath.Dir(gomod))
+	} else {
+		// not in a module
+		return nil
+	}
+
+	var (
+		modules     []hostModule
+		modReplaces []replacement
+		requires    []requirement
+		mainModule  string
+		lang        = s.lang
+	)
+	for _, modDir := range modDirs {
+		mod, err := readModFile(modDir, "mod", filepath.Join(modDir, "go.mod"))
+		if err != nil {
+			return err
+		}
+		modules = append(modules, hostModule{Path: mod.Module.Path, Dir: modDir})
+		modReplaces = append(modReplaces, absReplaces(modDir, mod.Replace)...)
+		requires = append(requires, mod.Require...)
+		sumFiles = append(sumFiles, filepath.Join(modDir, "go.sum"))
+
+		if rel, err := filepath.Rel(modDir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+			// the innermost module containing dir
+			if mainModule == "" || len(mod.Module.Path) > len(mainModule) {
+				mainModule = mod.Module.Path
+			}
+		}
+
+		// the session module must not be older than the modules it requires
+		if v := goversion.Lang("go" + mod.Go); v != "" && lang != "" && goversion.Compare(v, lang) > 0 {
+			lang = v
+		}
+	}
+	if mainModule == "" && len(modules) > 0 {
+		mainModule = modules[0].Path
+	}
+
+	// go.work replaces the modules first, then the modules in it do;
+	// the host modules are replaced by their directories
+	replaced := map[string]bool{}
+	for _, m := range modules {
+		replaced[m.Path] = true
+	}
+	var uniqReplaces []replacement
+	for _, r := range append(replaces, modReplaces...) {
+		if key := modVersion(r.Old.Path, r.Old.Version); !replaced[key] && !replaced[r.Old.Path] {
+			replaced[key] = true
+			uniqReplaces = append(uniqReplaces, r)
+		}
+	}
+
+	if err := writeGoSum(filepath.Join(s.tempDir, "go.sum"), sumFiles); err != nil {
+		return err
+	}
+
+	// the requirements of host modules are listed in the session module
+	// for the packages they import (see "module graph pruning")
+	var hostRequires []requirement
+	required := map[string]bool{}
+	for _, m := range modules {
+		required[m.Path] = true
+	}
+	for _, r := range requires {
+		if !required[r.Path] {
+			required[r.Path] = true
+			hostRequires = append(hostRequires, requirement{Path: r.Path, Version: r.Version, Indirect: true})
+		}
+	}
+
+	s.hostModules = modules
+	s.hostRequires = hostRequires
+	s.replaces = uniqReplaces
+	s.mainModule = mainModule
+	if lang != s.lang {
+		s.infof("language version raised to %s", lang)
+		s.lang = lang
+		s.types.GoVersion = lang
+	}
+
+	return s.writeGoMod()
+}
+
+// goEnv returns the values of the go environment variables in dir.
+func goEnv(dir string, names ...string) ([]string, error) {
+	cmd := exec.Command("go", append([]string{"env"}, names...)...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	values := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(values) != len(names) {
+		return nil, fmt.Errorf("go env: unexpected output: %q", out)
+	}
+	return values, nil
+}
+
+// readModFile reads a go.mod or go.work file by "go <mod|work> edit -json".
+func readModFile(dir, kind, path string) (*modFile, error) {
+	cmd := exec.Command("go", kind, "edit", "-json", path)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var mod modFile
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &mod, nil
+}
+
+// absReplaces returns the replacements with the relative directories
+// resolved against dir, as the session module is elsewhere.
+func absReplaces(dir string, replaces []replacement) []replacement {
+	var result []replacement
+	for _, r := range replaces {
+		if r.New.Version == "" {
+			r.New.Path = absDir(dir, r.New.Path)
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func absDir(base, dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(base, dir)
+}
+
+// writeGoSum writes the lines of the go.sum files to path,
+// so that the checksums of the dependencies of host modules are known.
+func writeGoSum(path string, sumFiles []string) error {
+	var (
+		buf  bytes.Buffer
+		seen = map[string]bool{}
+	)
+	for _, sumFile := range sumFiles {
+		b, err := ioutil.ReadFile(sumFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line == "" || seen[line] {
+				continue
+			}
+			seen[line] = true
+			fmt.Fprintln(&buf, line)
+		}
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,457 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+)
+
+// Persistent evaluation
+//
+// Usually every run of the session executes all the statements entered so far.
+// When persistent evaluation is enabled, the generated program saves the values
+// of the variables into a state file at the end of main, and the next run
+// restores them from the file and executes only the statements of the new input.
+//
+// Values are saved using encoding/gob, so the state can be persisted only when
+// every variable is of a type that gob can encode faithfully (see isPersistable).
+// Otherwise the session falls back to running all the statements, telling the
+// user once which variable cannot be saved.
+
+const (
+	restorerName = "__gore_restore"
+	saverName    = "__gore_save"
+)
+
+const persistSource = `package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"reflect"
+)
+
+var __gore_state map[string][]byte
+
+func ` + restorerName + `(path, name string, v interface{}) {
+	if __gore_state == nil {
+		__gore_state = map[string][]byte{}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&__gore_state); err != nil {
+			panic(err)
+		}
+	}
+	if b, ok := __gore_state[name]; ok {
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+			panic("gore: could not restore " + name + ": " + err.Error())
+		}
+	}
+}
+
+func ` + saverName + `(path string, names []string, vs ...interface{}) {
+	state := map[string][]byte{}
+	for i, v := range vs {
+		if rv := reflect.ValueOf(v).Elem(); rv.Kind() == reflect.Interface && rv.IsNil() {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			ioutil.WriteFile(path+".unsaved", []byte(names[i]), 0644)
+			return
+		}
+		state[names[i]] = buf.Bytes()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return
+	}
+	ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+`
+
+// persistentVar is a variable whose value is carried over runs.
+type persistentVar struct {
+	name   string
+	typ    string
+	global bool
+	pos    token.Pos
+}
+
+// runPersistent runs the session saving the variables to a state file.
+// If incremental is true and the state of the previous run is available,
+// only the statements after that run are executed.
+func (s *Session) runPersistent(incremental bool) error {
+	helperPath := filepath.Join(s.tempDir, "gore_persist.go")
+	helper, err := parser.ParseFile(s.fset, helperPath, persistSource, parser.Mode(0))
+	if err != nil {
+		return err
+	}
+
+	vars, unsaved, ok := s.persistentVars()
+	if incremental && unsaved != "" {
+		s.warnUnsaved(unsaved)
+	}
+
+	undoWait := s.prepareWait()
+	defer undoWait()
+	undoValues := s.prepareValues()
+	defer undoValues()
+
+	stmts := s.mainBody.List
+	from := 0
+	if incremental && ok && s.statePath != "" {
+		from = len(stmts)
+		for i, stmt := range stmts {
+			if n, isMarker := markerNo(stmt); isMarker && n > s.stateInput {
+				from = i
+				break
+			}
+		}
+	}
+
+	boundary := s.mainBody.Rbrace
+	if from < len(stmts) {
+		boundary = stmts[from].Pos()
+	}
+
+	var body []ast.Stmt
+	if from > 0 {
+		var prologue bytes.Buffer
+		for _, stmt := range stmts[:from] {
+			// types and constants local to main are re-declared as they are
+			if decl, ok := stmt.(*ast.DeclStmt); ok {
+				if gen, ok := decl.Decl.(*ast.GenDecl); ok && gen.Tok != token.VAR {
+					body = append(body, stmt)
+				}
+			}
+		}
+		for _, v := range vars {
+			if v.global {
+				fmt.Fprintf(&prologue, "%s(%q, %q, &%s)\n", restorerName, s.statePath, v.name, v.name)
+			}
+		}
+		for _, v := range vars {
+			if !v.global && v.pos < boundary {
+				fmt.Fprintf(&prologue, "var %s %s\n", v.name, v.typ)
+				fmt.Fprintf(&prologue, "%s(%q, %q, &%s)\n", restorerName, s.statePath, v.name, v.name)
+			}
+		}
+		restore, err := s.parseStmts(prologue.String())
+		if err != nil {
+			return err
+		}
+		body = append(body, restore...)
+	}
+	body = append(body, stmts[from:]...)
+
+	statePath := filepath.Join(s.tempDir, fmt.Sprintf("gore_state_%d.gob", s.inputNo))
+	os.Remove(statePath)
+	os.Remove(statePath + ".unsaved")
+	if ok {
+		names := make([]string, len(vars))
+		refs := make([]string, len(vars))
+		for i, v := range vars {
+			names[i] = fmt.Sprintf("%q", v.name)
+			refs[i] = "&" + v.name
+		}
+		save, err := s.parseStmts(fmt.Sprintf(
+			"%s(%q, []string{%s}%s)",
+			saverName, statePath, strings.Join(names, ", "), strings.Join(append([]string{""}, refs...), ", "),
+		))
+		if err != nil {
+			return err
+		}
+		body = append(body, save...)
+	}
+
+	file := s.runFile(body, helper)
+
+	var buf bytes.Buffer
+	if err := s.printFile(&buf, file); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.tempFilePath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(helperPath, []byte(persistSource), 0644); err != nil {
+		return err
+	}
+
+	debugf("persist :: from=%d/%d state=%q", from, len(stmts), s.statePath)
+
+	files := append([]string{}, s.extraFilePaths...)
+	err = s.goRun(append(files, helperPath, s.tempFilePath), s.outputSince(!incremental))
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(statePath); err == nil {
+		s.statePath = statePath
+		s.stateInput = s.inputNo
+	} else {
+		debugf("persist :: state not saved")
+		s.statePath = ""
+		if name, err := ioutil.ReadFile(statePath + ".unsaved"); err == nil {
+			s.warnUnsaved(string(name))
+		}
+	}
+
+	return nil
+}
+
+// warnUnsaved tells the user that the variable name cannot be saved,
+// once for each variable.
+func (s *Session) warnUnsaved(name string) {
+	if s.unsavedWarned == nil {
+		s.unsavedWarned = map[string]bool{}
+	}
+	if s.unsavedWarned[name] {
+		return
+	}
+	s.unsavedWarned[name] = true
+	s.infof("persist: %s cannot be saved; the inputs run again from the start", name)
+}
+
+// parseStmts parses in as a list of statements.
+func (s *Session) parseStmts(in string) ([]ast.Stmt, error) {
+	src := fmt.Sprintf("package P; func F() {\n%s\n}", in)
+	f, err := parser.ParseFile(s.fset, "persist.go", src, parser.Mode(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Decls[0].(*ast.FuncDecl).Body.List, nil
+}
+
+// runFile builds a copy of the session file whose main body is replaced by body.
+// Imports not used by the new file are turned into blank imports.
+func (s *Session) runFile(body []ast.Stmt, helper *ast.File) *ast.File {
+	file := *s.file
+	file.Decls = make([]ast.Decl, len(s.file.Decls))
+	var specs []*ast.ImportSpec
+	for i, decl := range s.file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl == s.mainFunc() {
+				main := *decl
+				main.Body = &ast.BlockStmt{Lbrace: decl.Body.Lbrace, List: body, Rbrace: decl.Body.Rbrace}
+				file.Decls[i] = &main
+				continue
+			}
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				gen := *decl
+				gen.Specs = make([]ast.Spec, len(decl.Specs))
+				for j, spec := range decl.Specs {
+					spec := *spec.(*ast.ImportSpec)
+					if spec.Name != nil && spec.Name.Name == "_" {
+						spec.Name = nil
+					}
+					gen.Specs[j] = &spec
+					specs = append(specs, &spec)
+				}
+				file.Decls[i] = &gen
+				continue
+			}
+		}
+		file.Decls[i] = decl
+	}
+
+	info := types.Info{
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	files := s.checkFiles()
+	conf.Check("main", s.fset, append(files, helper, &file), &info)
+
+	used := map[types.Object]bool{}
+	for _, obj := range info.Uses {
+		if _, ok := obj.(*types.PkgName); ok {
+			used[obj] = true
+		}
+	}
+	for _, spec := range specs {
+		var obj types.Object
+		if spec.Name != nil {
+			if spec.Name.Name == "." {
+				continue
+			}
+			obj = info.Defs[spec.Name]
+		} else {
+			obj = info.Implicits[spec]
+		}
+		if obj != nil && !used[obj] {
+			spec.Name = ast.NewIdent("_")
+		}
+	}
+
+	return &file
+}
+
+// persistentVars returns package-level variables and variables declared
+// in the main function, in the order of declaration.
+// ok reports whether all of them can be persisted; if not, unsaved is
+// the name of the first one which cannot be.
+func (s *Session) persistentVars() (vars []persistentVar, unsaved string, ok bool) {
+	info := types.Info{
+		Defs:   make(map[*ast.Ident]types.Object),
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	files := s.checkFiles()
+	pkg, _ := conf.Check("main", s.fset, append(files, s.file), &info)
+	if pkg == nil {
+		return nil, "", false
+	}
+
+	mainScope := info.Scopes[s.mainFunc().Type]
+	if mainScope == nil {
+		return nil, "", false
+	}
+
+	ok = true
+	qualified := true
+	qualifier := func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		for _, imp := range s.file.Imports {
+			if strings.Trim(imp.Path.Value, `"`) != p.Path() {
+				continue
+			}
+			if imp.Name == nil || imp.Name.Name == "_" {
+				return p.Name()
+			}
+			if imp.Name.Name == "." {
+				return ""
+			}
+			return imp.Name.Name
+		}
+		qualified = false
+		return p.Name()
+	}
+
+	fail := func(name string) {
+		if ok {
+			unsaved = name
+		}
+		ok = false
+	}
+
+	add := func(scope *types.Scope, global bool) {
+		for _, name := range scope.Names() {
+			v, isVar := scope.Lookup(name).(*types.Var)
+			if !isVar || name == "_" {
+				continue
+			}
+			if global && s.pkg != nil && (v.Pos() < s.file.Pos() || v.Pos() >= s.file.End()) {
+				// variables of the package are initialized by the package
+				continue
+			}
+			if global && mainScope.Lookup(name) != nil {
+				// shadowed by a local variable; cannot be referred from main
+				fail(name)
+				continue
+			}
+			if !isPersistable(pkg, v.Type(), map[types.Type]bool{}) {
+				debugf("persist :: cannot persist %s (%s)", name, v.Type())
+				fail(name)
+				continue
+			}
+			qualified = true
+			typ := types.TypeString(v.Type(), qualifier)
+			if !qualified {
+				fail(name)
+			}
+			vars = append(vars, persistentVar{
+				name:   name,
+				typ:    typ,
+				global: global,
+				pos:    v.Pos(),
+			})
+		}
+	}
+
+	add(pkg.Scope(), true)
+	add(mainScope, false)
+
+	sort.SliceStable(vars, func(i, j int) bool {
+		if vars[i].global != vars[j].global {
+			return vars[i].global
+		}
+		return vars[i].pos < vars[j].pos
+	})
+
+	return vars, unsaved, ok
+}
+
+// isPersistable reports whether values of type t survive
+// being encoded and decoded by encoding/gob.
+// Pointers, functions and channels are not persistable as well as
+// structs with unexported fields, which gob silently drops.
+// Interface values are persistable only when they are nil,
+// which is checked at runtime.
+func isPersistable(pkg *types.Package, t types.Type, seen map[types.Type]bool) bool {
+	if seen[t] {
+		return true
+	}
+	seen[t] = true
+
+	switch t := t.(type) {
+	case *types.Basic:
+		return t.Kind() != types.UnsafePointer && t.Kind() != types.Invalid
+	case *types.Named:
+		obj := t.Obj()
+		if obj.Pkg() != nil && obj.Pkg() != pkg && !obj.Exported() {
+			return false
+		}
+		for _, methods := range [][2]string{
+			{"GobEncode", "GobDecode"},
+			{"MarshalBinary", "UnmarshalBinary"},
+		} {
+			ms := types.NewMethodSet(types.NewPointer(t))
+			if ms.Lookup(obj.Pkg(), methods[0]) != nil && ms.Lookup(obj.Pkg(), methods[1]) != nil {
+				return true
+			}
+		}
+		return isPersistable(pkg, t.Underlying(), seen)
+	case *types.Slice:
+		return isPersistable(pkg, t.Elem(), seen)
+	case *types.Array:
+		return isPersistable(pkg, t.Elem(), seen)
+	case *types.Map:
+		return isPersistable(pkg, t.Key(), seen) && isPersistable(pkg, t.Elem(), seen)
+	case *types.Struct:
+		if t.NumFields() == 0 {
+			return false
+		}
+		for i := 0; i < t.NumFields(); i++ {
+			f := t.Field(i)
+			if !f.Exported() || !isPersistable(pkg, f.Type(), seen) {
+				return false
+			}
+		}
+		return true
+	case *types.Interface:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,277 @@
+package gore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/printer"
+	"go/token"
+)
+
+// In-package evaluation
+//
+// With -pkg, the session is compiled as a part of the target package, so that
+// inputs can refer to its unexported identifiers. The files of the package
+// are not modified: the session files are added to the package as test files
+// by an overlay (see "go help build") together with a test harness, and the
+// test binary of the package runs only the harness. The package is thus built
+// as "go test" does, with its build constraints, cgo, embedded files, and the
+// initialization of the package and its tests (including TestMain).
+//
+// To type-check inputs, the session file is checked with the files of the
+// package, without its main function if the package is a command.
+
+const (
+	// pkgMainName is the name of the main function of the session in the package.
+	pkgMainName = "__gore_main"
+	harnessName = "Test__gore"
+)
+
+const harnessSource = `package %s
+
+import (
+	"os"
+	"testing"
+)
+
+func ` + harnessName + `(t *testing.T) {
+	// panics crash the program as in package main, not failing the test
+	done := make(chan struct{})
+	go func() {
+		` + pkgMainName + `()
+		close(done)
+	}()
+	<-done
+
+	// exit before the test binary reports "PASS"
+	os.Exit(0)
+}
+`
+
+// targetPackage is the package which the session is evaluated in.
+type targetPackage struct {
+	ImportPath  string
+	Name        string
+	Dir         string
+	GoFiles     []string
+	CgoFiles    []string
+	TestGoFiles []string
+
+	// the files parsed for fset
+	fset  *token.FileSet
+	files []*ast.File
+
+	// the latest modification time of the files when listed
+	modTime time.Time
+}
+
+// includePackage makes the session evaluated inside the package specified
+// by path, which is an import path or a directory.
+func (s *Session) includePackage(path string) error {
+	pkg, err := s.listPackage(path)
+	if err != nil {
+		return err
+	}
+
+	s.pkg = pkg
+	if _, err := s.packageFiles(); err != nil {
+		s.pkg = nil
+		return err
+	}
+	s.enterPackage()
+	if err := s.saveVersion(pkg.Dir); err != nil {
+		return err
+	}
+
+	s.infof("evaluating in package %s", pkg.ImportPath)
+
+	return nil
+}
+
+// listPackage lists the package specified by path with "go list".
+func (s *Session) listPackage(path string) (*targetPackage, error) {
+	cmd := exec.Command("go", "list", "-json", path)
+	cmd.Dir = s.tempDir
+	if build.IsLocalImport(path) || filepath.IsAbs(path) {
+		// the package is looked up in the module of the directory
+		cmd = exec.Command("go", "list", "-json", ".")
+		cmd.Dir = path
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+
+	var pkg targetPackage
+	if err := json.Unmarshal(out, &pkg); err != nil {
+		return nil, err
+	}
+	pkg.modTime = latestModTime(pkg.Dir)
+
+	return &pkg, nil
+}
+
+// enterPackage sets up the session file and the type checker
+// for the target package.
+func (s *Session) enterPackage() {
+	s.file.Name.Name = s.pkg.Name
+	s.types.FakeImportC = true
+}
+
+// packageFiles returns the files of the target package parsed with
+// the current file set of the session.
+func (s *Session) packageFiles() ([]*ast.File, error) {
+	p := s.pkg
+	if p == nil {
+		return nil, nil
+	}
+	if p.fset == s.fset {
+		return p.files, nil
+	}
+
+	var files []*ast.File
+	for _, names := range [][]string{p.GoFiles, p.CgoFiles, p.TestGoFiles} {
+		for _, name := range names {
+			f, err := parseKeptFile(s.fset, s.kept, filepath.Join(p.Dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if f == nil {
+				continue
+			}
+			if p.Name == "main" {
+				// main of the command is replaced by that of the session
+				decls := f.Decls[:0:0]
+				for _, decl := range f.Decls {
+					if fd, ok := decl.(*ast.FuncDecl); !ok || fd.Recv != nil || fd.Name.Name != "main" {
+						decls = append(decls, decl)
+					}
+				}
+				f.Decls = decls
+			}
+			files = append(files, f)
+		}
+	}
+
+	p.fset, p.files = s.fset, files
+	return files, nil
+}
+
+// checkFiles returns the files which the session file is type-checked with:
+// the files included by -context and the files of the package of -pkg.
+func (s *Session) checkFiles() []*ast.File {
+	files := append([]*ast.File{}, s.extraFiles...)
+	pkgFiles, err := s.packageFiles()
+	if err != nil {
+		debugf("packageFiles :: err = %s", err)
+	}
+	return append(files, pkgFiles...)
+}
+
+// buildPackageTest builds the test binary of the target package including
+// files, which are the files of the session written for package main.
+// It returns the path to the binary.
+func (s *Session) buildPackageTest(files []string, deadline time.Time) (string, error) {
+	pkgDir := filepath.Join(s.tempDir, "pkg")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		return "", err
+	}
+
+	// the files keep their names in the messages of the compiler
+	overlay := map[string]string{}
+	for _, file := range files {
+		src, err := s.packageSource(file)
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(pkgDir, filepath.Base(file))
+		if err := ioutil.WriteFile(path, src, 0644); err != nil {
+			return "", err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".go") + "_test.go"
+		overlay[filepath.Join(s.pkg.Dir, name)] = path
+	}
+
+	harnessPath := filepath.Join(pkgDir, "gore_harness.go")
+	if err := ioutil.WriteFile(harnessPath, []byte(fmt.Sprintf(harnessSource, s.pkg.Name)), 0644); err != nil {
+		return "", err
+	}
+	overlay[filepath.Join(s.pkg.Dir, "gore_harness_test.go")] = harnessPath
+
+	overlayPath, err := s.writeOverlay(overlay)
+	if err != nil {
+		return "", err
+	}
+
+	bin := filepath.Join(s.tempDir, "gore_session.test")
+	args := []string{"test", "-c", "-o", bin, "-overlay", overlayPath, s.pkg.ImportPath}
+	debugf("go %s", strings.Join(args, " "))
+	cmd := exec.Command("go", args...)
+	cmd.Dir = s.tempDir
+	ef := newErrFilter(s.stderr, s.srcMap)
+	defer ef.Close()
+	cmd.Stdout = ef
+	cmd.Stderr = ef
+	if err := s.build(cmd, deadline); err != nil {
+		return "", err
+	}
+
+	return bin, nil
+}
+
+// writeOverlay writes the overlay of the go command replacing the files
+// by overlay and the kept files (see keepVersion), returning its path.
+func (s *Session) writeOverlay(overlay map[string]string) (string, error) {
+	replace := map[string]string{}
+	for path, saved := range s.kept {
+		replace[path] = saved
+	}
+	for path, file := range overlay {
+		replace[path] = file
+	}
+
+	b, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		return "", err
+	}
+	overlayPath := filepath.Join(s.tempDir, "gore_overlay.json")
+	if err := ioutil.WriteFile(overlayPath, b, 0644); err != nil {
+		return "", err
+	}
+	return overlayPath, nil
+}
+
+// packageSource returns the source of file, written for package main,
+// as a file of the target package.
+func (s *Session) packageSource(file string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Name.Name = s.pkg.Name
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil && fd.Name.Name == "main" {
+			fd.Name.Name = pkgMainName
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
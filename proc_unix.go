@@ -0,0 +1,50 @@
+//go:build !windows
+
+package gore
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// killProcessTree kills the process pid and all of its descendants.
+func killProcessTree(pid int) error {
+	// stop the processes first so that they do not spawn new ones
+	syscall.Kill(pid, syscall.SIGSTOP)
+
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=").Output()
+	if err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		return err
+	}
+
+	children := map[int][]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		child, err1 := strconv.Atoi(fields[0])
+		parent, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+
+	pids := []int{pid}
+	for i := 0; i < len(pids); i++ {
+		for _, child := range children[pids[i]] {
+			syscall.Kill(child, syscall.SIGSTOP)
+			pids = append(pids, child)
+		}
+	}
+
+	for _, p := range pids {
+		syscall.Kill(p, syscall.SIGKILL)
+	}
+
+	return nil
+}
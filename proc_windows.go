@@ -0,0 +1,11 @@
+package gore
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// killProcessTree kills the process pid and all of its descendants.
+func killProcessTree(pid int) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
@@ -24,7 +24,7 @@ quickFixAttempt:
 			Types: make(map[ast.Expr]types.TypeAndValue),
 		}
 
-		files := s.extraFiles
+		files := s.checkFiles()
 		files = append(files, s.file)
 
 		config := quickfix.Config{
@@ -57,6 +57,50 @@ quickFixAttempt:
 			//   __gore_pp(funcWithSideEffectReturningNoValue())
 			// to
 			//   funcWithSideEffectReturningNoValue()
+			// "assignment mismatch: 1 variable but f() returns 2 values":
+			//
+			// convert
+			//   x := f()
+			// to
+			//   x, __gore_err0 := f()
+			//   __gore_check(__gore_err0)
+			// if f returns an error as the last result
+			if s.unwrap && strings.HasPrefix(err.Msg, "assignment mismatch: ") && s.unwrapAssign(err.Pos) {
+				continue quickFixAttempt
+			}
+
+			// "imported and not used", as the type checker reports
+			// since Go 1.20 instead of "imported but not used":
+			//
+			// convert
+			//   import "strings"
+			// to
+			//   import _ "strings"
+			// as quickfix does, which is made explicit again by clearQuickFix
+			if strings.Contains(err.Msg, " imported ") && strings.HasSuffix(err.Msg, " and not used") {
+				nodepath, _ := astutil.PathEnclosingInterval(s.file, err.Pos, err.Pos)
+				for _, node := range nodepath {
+					if imp, ok := node.(*ast.ImportSpec); ok && (imp.Name == nil || imp.Name.Name != "_") {
+						imp.Name = ast.NewIdent("_")
+						continue quickFixAttempt
+					}
+				}
+			}
+
+			// "declared and not used: x", as the type checker reports
+			// since Go 1.20 instead of "x declared but not used":
+			//
+			// append
+			//   _ = x
+			// to the block declaring x as quickfix does, which is removed
+			// again by clearQuickFix
+			if strings.HasPrefix(err.Msg, declaredNotUsedPrefix) {
+				name := strings.TrimPrefix(err.Msg, declaredNotUsedPrefix)
+				if fixDeclaredNotUsed(s.file, err.Pos, name) {
+					continue quickFixAttempt
+				}
+			}
+
 			if strings.HasSuffix(err.Msg, " used as value") {
 				nodepath, _ := astutil.PathEnclosingInterval(s.file, err.Pos, err.Pos)
 
@@ -75,7 +119,7 @@ quickFixAttempt:
 
 						stmts := s.mainBody.List[0:i]
 						for _, expr := range exprs {
-							stmts = append(stmts, &ast.ExprStmt{expr})
+							stmts = append(stmts, &ast.ExprStmt{X: expr})
 						}
 
 						s.mainBody.List = append(stmts, s.mainBody.List[i+1:]...)
@@ -88,9 +132,41 @@ quickFixAttempt:
 		debugf("quickFix :: give up: %#v", err)
 	}
 
+	if s.unwrap {
+		s.unwrapPrinted()
+	}
+
 	return nil
 }
 
+const declaredNotUsedPrefix = "declared and not used: "
+
+// fixDeclaredNotUsed appends "_ = name" to the innermost block of f
+// enclosing pos, where name is declared.
+func fixDeclaredNotUsed(f *ast.File, pos token.Pos, name string) bool {
+	stmt := &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent("_")},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{ast.NewIdent(name)},
+	}
+
+	nodepath, _ := astutil.PathEnclosingInterval(f, pos, pos)
+	for _, node := range nodepath {
+		switch node := node.(type) {
+		case *ast.BlockStmt:
+			node.List = append(node.List, stmt)
+		case *ast.CaseClause:
+			node.Body = append(node.Body, stmt)
+		case *ast.CommClause:
+			node.Body = append(node.Body, stmt)
+		default:
+			continue
+		}
+		return true
+	}
+	return false
+}
+
 func (s *Session) clearQuickFix() {
 	// make all import specs explicit (i.e. no "_").
 	for _, imp := range s.file.Imports {
@@ -181,7 +257,7 @@ func printedExprs(stmt ast.Stmt) []ast.Expr {
 		return nil
 	}
 
-	if !isNamedIdent(call.Fun, printerName) {
+	if !isNamedIdent(call.Fun, printerName) && !isNamedIdent(call.Fun, unwrapPrinterName) {
 		return nil
 	}
 
@@ -205,6 +281,7 @@ var pureBuiltinFuncNames = map[string]bool{
 // - types
 // - selectors ("x.y")
 // - slices ("a[n:m]")
+// - instantiations ("f[int, string]")
 // - literals ("1")
 // - type conversion ("int(1)")
 // - type assertion ("x.(int)")
@@ -248,6 +325,17 @@ func (s *Session) isPureExpr(expr ast.Expr) bool {
 		return true
 	case *ast.IndexExpr:
 		return s.isPureExpr(expr.X) && s.isPureExpr(expr.Index)
+	case *ast.IndexListExpr:
+		// instantiation of a generic function or type ("f[int, string]")
+		if !s.isPureExpr(expr.X) {
+			return false
+		}
+		for _, index := range expr.Indices {
+			if !s.isPureExpr(index) {
+				return false
+			}
+		}
+		return true
 	case *ast.SelectorExpr:
 		return s.isPureExpr(expr.X)
 	case *ast.SliceExpr:
@@ -0,0 +1,95 @@
+package gore
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// Failed runs
+//
+// The program of the session is built and run as separate steps, so that a
+// failed run is told whether it failed to compile, panicked (or died of
+// another fatal error of the runtime) or exited with a non-zero status, e.g.
+// by os.Exit or log.Fatal. Eval returns ErrCompile, ErrPanic or ErrExit
+// respectively.
+//
+// An input which fails to compile is dropped. An input which panics is
+// dropped too, unless :set onpanic keep is set, with which it is kept with
+// its effects before the panic; the later runs panic again unless the panic
+// depends on something outside. An input which exits with a non-zero status
+// is kept, as the exit is usually intended.
+
+// checkExitStatus is the exit status of the program when an error checked
+// by checkErrName is not nil, which is taken as a panic.
+const checkExitStatus = 3
+
+// runError is returned when the program of the session fails to compile,
+// panics or exits with a non-zero status.
+type runError struct {
+	// err is ErrCompile, ErrPanic or ErrExit
+	err    Error
+	reason string
+	input  int
+}
+
+func (e *runError) Error() string {
+	if e.err == ErrCompile {
+		return "compile failed"
+	}
+	if e.reason == "" {
+		return fmt.Sprintf("input #%d failed", e.input)
+	}
+	return fmt.Sprintf("%s while running input #%d", e.reason, e.input)
+}
+
+// runningTraceRegexp matches the trace of the goroutine running a panic or
+// a fatal error, which the runtime prints before exiting with status 2.
+var runningTraceRegexp = regexp.MustCompile(`(?m)^goroutine \d+ \[running\]:$`)
+
+// exitFailure classifies the exit of the program by exitErr and its error
+// output stderr; input is the input running then.
+func exitFailure(exitErr *exec.ExitError, stderr []byte, input int) *runError {
+	status := exitErr.ExitCode()
+	switch {
+	case status == checkExitStatus:
+		// the error is reported by the program
+		return &runError{err: ErrPanic, input: input}
+	case status == 2 && runningTraceRegexp.Match(stderr):
+		return &runError{err: ErrPanic, reason: "panicked", input: input}
+	case status < 0:
+		// killed by a signal
+		return &runError{err: ErrExit, reason: exitErr.Error(), input: input}
+	}
+	return &runError{err: ErrExit, reason: fmt.Sprintf("exited with status %d", status), input: input}
+}
+
+// isRunFailure reports whether err returned by Eval means that the input
+// was accepted but failed to compile or run.
+func isRunFailure(err error) bool {
+	switch err {
+	case ErrCmdRun, ErrCompile, ErrPanic, ErrExit:
+		return true
+	}
+	return false
+}
+
+// setOnPanic sets whether to keep the inputs which panic by "keep" or "drop".
+func (s *Session) setOnPanic(arg string) error {
+	switch arg {
+	case "keep":
+		s.keepPanicked = true
+	case "drop":
+		s.keepPanicked = false
+	default:
+		return fmt.Errorf("invalid argument: %s (must be keep or drop)", arg)
+	}
+	return nil
+}
+
+func (s *Session) onPanic() string {
+	if s.keepPanicked {
+		return "keep"
+	}
+	return "drop"
+}
@@ -2,11 +2,10 @@ package gore
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"go/ast"
-	"go/build"
-	"go/importer"
 	"go/parser"
 	"go/printer"
 	"go/scanner"
@@ -16,11 +15,15 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
-	"syscall"
+	"time"
 	"unicode"
 
+	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/imports"
 
 	"github.com/motemen/go-quickfix"
@@ -36,20 +39,145 @@ type Session struct {
 	typeInfo       types.Info
 	extraFilePaths []string
 	extraFiles     []*ast.File
+	contexts       []*contextFile
+	contextPkgs    []*contextPackage
 	autoImport     bool
 	mainBody       *ast.BlockStmt
 	lastStmts      []ast.Stmt
 	lastDecls      []ast.Decl
+	lastImports    []*ast.ImportSpec
 	stdout         io.Writer
 	stderr         io.Writer
+
+	// lastRenames are the original names of the identifiers
+	// renamed by the latest input; see shadow.go.
+	lastRenames map[*ast.Ident]string
+
+	// inputNo is the serial number of the latest input,
+	// recorded in the main body by marker statements.
+	inputNo int
+
+	// inputs are the accepted inputs in order, including commands
+	// which modify the code, so that they can be saved and replayed.
+	inputs []sessionInput
+	edited bool
+
+	// declInputs maps the keys of package-level declarations
+	// (see declKey) to the number of the input which declared them.
+	declInputs map[string]int
+
+	// initialImports are the quoted paths imported by the initial source,
+	// which stay imported when the inputs importing them are removed.
+	initialImports map[string]bool
+
+	// timeout limits the duration of a run if positive.
+	timeout time.Duration
+
+	// srcMap maps the positions in the session file last run to the inputs,
+	// whose sources are in inputSrcs by their numbers; see srcmap.go.
+	srcMap    *sourceMap
+	inputSrcs map[int]string
+
+	// wait is how long main waits for the goroutines started by the inputs
+	// at its end if positive; see wait.go.
+	wait time.Duration
+
+	limits limits
+
+	// replayOutput shows the output of all the inputs on every run
+	// instead of only the latest one.
+	replayOutput bool
+
+	// keepPanicked keeps the inputs which panic; see result.go.
+	keepPanicked bool
+
+	// phase is the phase the latest input reached, ctx aborts its run,
+	// and the values it prints are collected to valuesPath if not empty,
+	// by the calls in valueCalls; see evalresult.go.
+	phase      Phase
+	ctx        context.Context
+	valuesPath string
+	valueCalls []valueCall
+
+	// unwrap unwraps the results of functions returning an error;
+	// see unwrap.go.
+	unwrap bool
+
+	// lang is the language version of the session and requires are
+	// the modules it requires; see module.go.
+	lang     string
+	requires []requirement
+
+	// pkg is the package specified by -pkg which the session is evaluated in;
+	// see pkg.go.
+	pkg *targetPackage
+
+	// kept maps the files of the packages kept at their previous versions
+	// to their saved copies, or "" if hidden; see context.go.
+	kept map[string]string
+
+	// hostModules are the modules of the working tree which the session is
+	// run inside with their requirements, mainModule is the one containing
+	// the current directory and replaces are their replace directives;
+	// see module.go.
+	hostModules  []hostModule
+	hostRequires []requirement
+	mainModule   string
+	replaces     []replacement
+
+	// persist enables persistent evaluation; see persist.go.
+	persist       bool
+	statePath     string
+	stateInput    int
+	unsavedWarned map[string]bool
+
+	// extraCommands are the commands registered to the session;
+	// see command.go.
+	extraCommands []command
+
+	// undoStack and redoStack hold the states before the changes
+	// of the session, for :undo and :redo; see undo.go.
+	undoStack []*snapshot
+	redoStack []*snapshot
+}
+
+// sessionInput is an accepted input with its number.
+// Commands share the number of the following input.
+type sessionInput struct {
+	no  int
+	src string
 }
 
 const printerName = "__gore_p"
 
+const markerName = "__gore_mark"
+
+const (
+	unwrapPrinterName = "__gore_pe"
+	checkErrName      = "__gore_check"
+	errPrinterName    = "__gore_perr"
+)
+
+// isHelperName reports whether name is of a function of the session
+// which is not an input.
+func isHelperName(name string) bool {
+	switch name {
+	case printerName, markerName, unwrapPrinterName, checkErrName, errPrinterName:
+		return true
+	}
+	return false
+}
+
 const initialSourceTemplate = `
 package main
 
-import %q
+import (
+	%q
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+)
 
 func ` + printerName + `(xx ...interface{}) {
 	for _, x := range xx {
@@ -57,6 +185,35 @@ func ` + printerName + `(xx ...interface{}) {
 	}
 }
 
+func ` + unwrapPrinterName + `(xx ...interface{}) {
+	if err, ok := xx[len(xx)-1].(error); ok {
+		` + errPrinterName + `(err)
+		return
+	}
+	` + printerName + `(xx[:len(xx)-1]...)
+}
+
+func ` + checkErrName + `(err error) {
+	if err != nil {
+		` + errPrinterName + `(err)
+		os.Exit(3) // checkExitStatus
+	}
+}
+
+func ` + errPrinterName + `(err error) {
+	prefix := "error: "
+	for ; err != nil; err = errors.Unwrap(err) {
+		os.Stderr.WriteString(prefix + err.Error() + " (" + reflect.TypeOf(err).String() + ")\n")
+		prefix = "  wraps: "
+	}
+}
+
+func ` + markerName + `(n int) {
+	m := "\x00gore:" + strconv.Itoa(n) + "\x00"
+	os.Stdout.WriteString(m)
+	os.Stderr.WriteString(m)
+}
+
 func main() {
 }
 `
@@ -84,6 +241,11 @@ func NewSession(stdout, stderr io.Writer) (*Session, error) {
 	}
 	s.tempFilePath = filepath.Join(s.tempDir, "gore_session.go")
 
+	s.lang = defaultLang()
+	if err = s.writeGoMod(); err != nil {
+		return s, err
+	}
+
 	if err = s.init(); err != nil {
 		return s, err
 	}
@@ -92,11 +254,19 @@ func NewSession(stdout, stderr io.Writer) (*Session, error) {
 }
 
 func (s *Session) init() (err error) {
+	if s.kept == nil {
+		s.kept = map[string]string{}
+	}
+	for _, p := range s.contextPkgs {
+		s.unkeepVersion(p.dir)
+	}
 	s.fset = token.NewFileSet()
-	s.types = &types.Config{Importer: importer.For("source", nil)}
+	s.types = &types.Config{Importer: s.newImporter(), GoVersion: s.lang}
 	s.typeInfo = types.Info{}
 	s.extraFilePaths = nil
 	s.extraFiles = nil
+	s.contexts = nil
+	s.contextPkgs = nil
 
 	var initialSource string
 	for _, pp := range printerPkgs {
@@ -119,9 +289,26 @@ func (s *Session) init() (err error) {
 
 	s.mainBody = s.mainFunc().Body
 
+	s.initialImports = map[string]bool{}
+	for _, imp := range s.file.Imports {
+		s.initialImports[imp.Path.Value] = true
+	}
+
+	if s.pkg != nil {
+		s.enterPackage()
+	}
+
 	s.lastStmts = nil
 	s.lastDecls = nil
 
+	s.statePath = ""
+	s.stateInput = 0
+
+	s.inputs = nil
+	s.edited = false
+	s.declInputs = map[string]int{}
+	s.inputSrcs = map[int]string{}
+
 	return nil
 }
 
@@ -131,34 +318,231 @@ func (s *Session) mainFunc() *ast.FuncDecl {
 
 // Run the session.
 func (s *Session) Run() error {
+	return s.run(false)
+}
+
+// run runs the session. If replay is true, all the statements are run again
+// showing their output.
+func (s *Session) run(replay bool) error {
+	if s.persist {
+		return s.runPersistent(!replay)
+	}
+
 	f, err := os.Create(s.tempFilePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	err = printer.Fprint(f, s.fset, s.file)
+	undoWait := s.prepareWait()
+	undoValues := s.prepareValues()
+	err = s.printFile(f, s.file)
+	undoValues()
+	undoWait()
 	if err != nil {
 		return err
 	}
 
-	return s.goRun(append(s.extraFilePaths, s.tempFilePath))
+	return s.goRun(append(s.extraFilePaths, s.tempFilePath), s.outputSince(replay))
+}
+
+// outputSince returns the number of the first input whose output is shown.
+func (s *Session) outputSince(replay bool) int {
+	if replay || s.replayOutput {
+		return 0
+	}
+	return s.inputNo
+}
+
+// goRun runs files showing the output of inputs numbered since or later.
+func (s *Session) goRun(files []string, since int) error {
+	if s.wait > 0 {
+		waitPath := filepath.Join(s.tempDir, "gore_wait.go")
+		if err := ioutil.WriteFile(waitPath, []byte(waitSource), 0644); err != nil {
+			return err
+		}
+		files = append([]string{waitPath}, files...)
+	}
+	if s.valuesPath != "" {
+		valuesPath := filepath.Join(s.tempDir, "gore_values.go")
+		if err := ioutil.WriteFile(valuesPath, []byte(valuesSource), 0644); err != nil {
+			return err
+		}
+		files = append([]string{valuesPath}, files...)
+	}
+
+	var deadline time.Time
+	if s.timeout > 0 {
+		deadline = time.Now().Add(s.timeout)
+	}
+
+	var cmd *exec.Cmd
+	if s.pkg != nil {
+		bin, err := s.buildPackageTest(files, deadline)
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command(bin, "-test.run=^"+harnessName+"$")
+		cmd.Dir = s.pkg.Dir // as go test does
+	} else {
+		bin, err := s.buildProgram(files, deadline)
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command(bin)
+		cmd.Dir = s.tempDir // as go run in the session module did
+	}
+	if err := s.limit(cmd); err != nil {
+		return err
+	}
+	s.phase = PhaseRun
+	if s.valuesPath != "" {
+		os.Remove(s.valuesPath)
+		cmd.Env = append(os.Environ(), "GORE_VALUES="+s.valuesPath)
+	}
+	cmd.Stdin = os.Stdin
+	stdout := newMarkFilter(s.stdout, since)
+	cmd.Stdout = stdout
+	defer stdout.Close()
+	ef := newErrFilter(s.stderr, s.srcMap)
+	defer ef.Close()
+	stderr := newMarkFilter(ef, since)
+	sample := &sampleWriter{}
+	cmd.Stderr = io.MultiWriter(stderr, sample)
+	defer stderr.Close()
+
+	reason, err := s.execute(cmd, deadline)
+	if reason != "" {
+		input := stdout.current
+		if stderr.current > input {
+			input = stderr.current
+		}
+		return &abortError{reason: reason, input: input, run: true}
+	}
+	if err != nil {
+		if reason := s.limits.exceeded(sample.Bytes(), cmd.ProcessState); reason != "" {
+			return &abortError{reason: reason, input: stderr.current, run: true}
+		}
+		if isDeadlock(sample.Bytes()) {
+			return &abortError{reason: "deadlock", input: stderr.current, run: true}
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitFailure(exitErr, sample.Bytes(), stderr.current)
+		}
+	}
+	return err
 }
 
-func (s *Session) goRun(files []string) error {
-	args := append([]string{"run"}, files...)
+// buildProgram builds files into the executable of the session.
+// It returns the path to the executable.
+func (s *Session) buildProgram(files []string, deadline time.Time) (string, error) {
+	bin := filepath.Join(s.tempDir, "gore_session")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+
+	args := []string{"build", "-o", bin}
+	if s.lang != "" {
+		// go.mod does not decide the language version of files given as arguments
+		args = append(args, "-gcflags=-lang="+s.lang)
+	}
+	if len(s.kept) > 0 {
+		overlayPath, err := s.writeOverlay(map[string]string{})
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-overlay", overlayPath)
+	}
+	args = append(args, files...)
 	debugf("go %s", strings.Join(args, " "))
 	cmd := exec.Command("go", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = s.stdout
-	ef := newErrFilter(s.stderr)
-	cmd.Stderr = ef
+	cmd.Dir = s.tempDir // in the session module
+	ef := newErrFilter(s.stderr, s.srcMap)
 	defer ef.Close()
-	return cmd.Run()
+	cmd.Stdout = ef
+	cmd.Stderr = ef
+
+	if err := s.build(cmd, deadline); err != nil {
+		return "", err
+	}
+	return bin, nil
+}
+
+// build runs cmd, which builds the program of the session.
+func (s *Session) build(cmd *exec.Cmd, deadline time.Time) error {
+	reason, err := s.execute(cmd, deadline)
+	if reason != "" {
+		return &abortError{reason: reason}
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return &runError{err: ErrCompile}
+	}
+	return err
+}
+
+// execute runs cmd until it exits. It is aborted on an interrupt, when the
+// context of the evaluation is done, or at deadline unless zero, and then
+// reason tells why.
+func (s *Session) execute(cmd *exec.Cmd, deadline time.Time) (reason string, err error) {
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	defer signal.Stop(sigch)
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return "", err
+	case <-sigch:
+		reason = "interrupted"
+	case <-s.context().Done():
+		reason = s.context().Err().Error()
+	case <-timeout:
+		reason = fmt.Sprintf("timed out after %s", s.timeout)
+	}
+
+	if err := killProcessTree(cmd.Process.Pid); err != nil {
+		debugf("killProcessTree: %s", err)
+	}
+	<-done
+
+	return reason, nil
+}
+
+// abortError is returned when a run is aborted by an interrupt, timeout
+// or resource limit, or dies of a deadlock.
+type abortError struct {
+	reason string
+	input  int
+	run    bool // aborted while running the program, not building it
+}
+
+func (e *abortError) Error() string {
+	if e.input <= 0 && e.run {
+		return e.reason + " while initializing the program"
+	}
+	if e.input <= 0 {
+		return e.reason + " while compiling"
+	}
+	return fmt.Sprintf("%s while running input #%d", e.reason, e.input)
 }
 
 func (s *Session) evalExpr(in string) (ast.Expr, error) {
-	expr, err := parser.ParseExpr(in)
+	expr, err := parser.ParseExprFrom(s.fset, "expr.go", in, parser.Mode(0))
 	if err != nil {
 		return nil, err
 	}
@@ -208,11 +592,17 @@ func (s *Session) evalStmt(in string) error {
 	}
 
 	s.appendStatements(stmts...)
+	s.shadowRedeclared(stmts)
 
 	return nil
 }
 
-func (s *Session) evalGenDecl(in string) error {
+// evalDecl evaluates top-level declarations other than functions at the prompt,
+// i.e. imports, types and constants, in the package scope. Variables are
+// rejected so that they are evaluated as statements in main, unless they
+// redefine package variables which the top-level declarations refer to.
+// Declarations which refer to names local to main are rejected too.
+func (s *Session) evalDecl(in string) error {
 	src := fmt.Sprintf("package P; %s", in)
 
 	f, err := parser.ParseFile(s.fset, "decl.go", src, parser.Mode(0))
@@ -220,22 +610,236 @@ func (s *Session) evalGenDecl(in string) error {
 		return err
 	}
 
-	ast.FilterFile(s.file, func(name string) bool {
-		if obj := f.Scope.Lookup(name); obj != nil {
-			return false
+	if len(f.Decls) == 0 && len(f.Imports) == 0 {
+		return errors.New("eval decl error")
+	}
+
+	for _, d := range f.Decls {
+		d, ok := d.(*ast.GenDecl)
+		if !ok {
+			return errors.New("eval decl error")
 		}
-		return true
+		if d.Tok == token.VAR && !s.referredByDecls(declKeys(d)) {
+			return errors.New("variables are declared in main")
+		}
+		if d.Tok != token.IMPORT && s.refersLocals(d) {
+			return errors.New("declaration refers to local names")
+		}
+	}
+
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := s.types.Importer.Import(path); err != nil {
+			return err
+		}
+	}
+
+	var stmts []ast.Stmt
+	for _, d := range f.Decls {
+		d := d.(*ast.GenDecl)
+		if d.Tok == token.IMPORT {
+			for _, spec := range d.Specs {
+				imp := spec.(*ast.ImportSpec)
+				path, _ := strconv.Unquote(imp.Path.Value)
+				var name string
+				if imp.Name != nil {
+					name = imp.Name.Name
+				}
+				added := astutil.AddNamedImport(s.fset, s.file, name, path)
+				if _, ok := s.declInputs[imp.Path.Value]; added || !ok {
+					s.declInputs[imp.Path.Value] = s.inputNo
+				}
+			}
+			continue
+		}
+		if stmt := buildPrintStmtOfDecl(d); stmt != nil {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	s.defineDecls(f)
+	if len(stmts) > 0 {
+		s.appendStatements(stmts...)
+	}
+
+	return nil
+}
+
+// refersLocals reports whether decl refers to names declared in main.
+func (s *Session) refersLocals(decl ast.Decl) bool {
+	info := types.Info{
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	files := s.checkFiles()
+	conf.Check("main", s.fset, append(files, s.file), &info)
+
+	mainScope := info.Scopes[s.mainFunc().Type]
+	if mainScope == nil {
+		return false
+	}
+
+	refers := false
+	ast.Inspect(decl, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && mainScope.Lookup(ident.Name) != nil {
+			refers = true
+		}
+		return !refers
 	})
 
-	if len(f.Decls) > 0 {
-		for _, d := range f.Decls {
-			s.file.Decls = append(s.file.Decls, d)
+	return refers
+}
+
+// referredByDecls reports whether any of names is a package variable which
+// the top-level declarations other than main refer to.
+func (s *Session) referredByDecls(names []string) bool {
+	info := types.Info{
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	pkg, _ := conf.Check("main", s.fset, append(s.checkFiles(), s.file), &info)
+	if pkg == nil {
+		return false
+	}
+
+	vars := map[types.Object]bool{}
+	for _, name := range names {
+		if obj, ok := pkg.Scope().Lookup(name).(*types.Var); ok {
+			vars[obj] = true
+		}
+	}
+	if len(vars) == 0 {
+		return false
+	}
+
+	mainFunc := s.mainFunc()
+	referred := false
+	for _, decl := range s.file.Decls {
+		if decl == mainFunc {
+			continue
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok && vars[info.Uses[ident]] {
+				referred = true
+			}
+			return !referred
+		})
+		if referred {
+			return true
 		}
 	}
+	return false
+}
+
+func (s *Session) evalGenDecl(in string) error {
+	src := fmt.Sprintf("package P; %s", in)
+
+	f, err := parser.ParseFile(s.fset, "decl.go", src, parser.Mode(0))
+	if err != nil {
+		return err
+	}
+
+	s.defineDecls(f)
 
 	return nil
 }
 
+// defineDecls adds the declarations of f other than imports to the session,
+// replacing the existing declarations of the same names.
+func (s *Session) defineDecls(f *ast.File) {
+	redeclared := func(name string) bool {
+		return name != "_" && f.Scope.Lookup(name) != nil
+	}
+
+	decls := make([]ast.Decl, 0, len(s.file.Decls))
+	for _, d := range s.file.Decls {
+		if d := withoutNames(d, redeclared); d != nil {
+			decls = append(decls, d)
+		}
+	}
+	s.file.Decls = decls
+
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			continue
+		}
+		s.file.Decls = append(s.file.Decls, d)
+		for _, key := range declKeys(d) {
+			s.declInputs[key] = s.inputNo
+		}
+	}
+}
+
+// withoutNames returns decl without the specs declaring names for which
+// redeclared returns true, or nil if nothing is left. Unlike ast.FilterDecl,
+// the names in a spec (like the fields of a struct) are left as they are,
+// and decl is not modified. The redeclared names of a spec declaring other
+// names too are replaced with _, so that the values are still evaluated,
+// as are those of the constants in a group, which keep their iota.
+func withoutNames(decl ast.Decl, redeclared func(string) bool) ast.Decl {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil && redeclared(d.Name.Name) {
+			return nil
+		}
+		return d
+
+	case *ast.GenDecl:
+		if d.Tok == token.IMPORT {
+			return d
+		}
+		specs := make([]ast.Spec, 0, len(d.Specs))
+		modified := false
+		for _, spec := range d.Specs {
+			switch spec := spec.(type) {
+			case *ast.TypeSpec:
+				if redeclared(spec.Name.Name) {
+					modified = true
+					continue
+				}
+			case *ast.ValueSpec:
+				names := make([]*ast.Ident, len(spec.Names))
+				changed, left := false, false
+				for i, name := range spec.Names {
+					names[i] = name
+					if redeclared(name.Name) {
+						names[i] = &ast.Ident{NamePos: name.NamePos, Name: "_"}
+						changed = true
+					} else if name.Name != "_" {
+						left = true
+					}
+				}
+				if changed {
+					modified = true
+					if !left && (d.Tok == token.VAR || len(d.Specs) == 1) {
+						continue
+					}
+					vs := *spec
+					vs.Names = names
+					specs = append(specs, &vs)
+					continue
+				}
+			}
+			specs = append(specs, spec)
+		}
+		if !modified {
+			return d
+		}
+		if len(specs) == 0 {
+			return nil
+		}
+		gen := *d
+		gen.Specs = specs
+		return &gen
+	}
+	return decl
+}
+
 func buildPrintStmt(exprs []ast.Expr) ast.Stmt {
 	vs := make([]ast.Expr, 0, len(exprs))
 	for _, v := range exprs {
@@ -288,13 +892,16 @@ func (s *Session) evalFunc(in string) error {
 	if !ok {
 		return errors.New("eval func error")
 	}
+	// functions are replaced by name, methods by the receiver type and name
+	key := declKey(newDecl)
 	for i, d := range s.file.Decls {
-		if d, ok := d.(*ast.FuncDecl); ok && d.Name.String() == newDecl.Name.String() {
+		if d, ok := d.(*ast.FuncDecl); ok && declKey(d) == key {
 			s.file.Decls = append(s.file.Decls[:i], s.file.Decls[i+1:]...)
 			break
 		}
 	}
 	s.file.Decls = append(s.file.Decls, newDecl)
+	s.declInputs[key] = s.inputNo
 	return nil
 }
 
@@ -316,9 +923,42 @@ func (s *Session) parseTokens(in string) error {
 }
 
 func (s *Session) appendStatements(stmts ...ast.Stmt) {
+	s.mainBody.List = append(s.mainBody.List, markerStmt(s.inputNo))
 	s.mainBody.List = append(s.mainBody.List, stmts...)
 }
 
+// markerStmt builds a statement "__gore_mark(n)", which marks
+// the beginning of the statements of the n-th input.
+func markerStmt(n int) ast.Stmt {
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun:  ast.NewIdent(markerName),
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}},
+		},
+	}
+}
+
+// markerNo returns the input number if stmt is a marker statement.
+func markerNo(stmt ast.Stmt) (int, bool) {
+	st, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return 0, false
+	}
+
+	call, ok := st.X.(*ast.CallExpr)
+	if !ok || !isNamedIdent(call.Fun, markerName) || len(call.Args) != 1 {
+		return 0, false
+	}
+
+	lit, ok := call.Args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(lit.Value)
+	return n, err == nil
+}
+
 // Error ...
 type Error string
 
@@ -327,6 +967,12 @@ const (
 	ErrContinue Error = "<continue input>"
 	ErrQuit     Error = "<quit session>"
 	ErrCmdRun   Error = "<command failed>"
+
+	// the input failed to compile, panicked or exited with a non-zero
+	// status; see result.go
+	ErrCompile Error = "<compile failed>"
+	ErrPanic   Error = "<panicked>"
+	ErrExit    Error = "<exited>"
 )
 
 func (e Error) Error() string {
@@ -353,6 +999,29 @@ func (s *Session) source(space bool) (string, error) {
 	return buf.String(), err
 }
 
+// userSource returns the source of the session for :print and :write,
+// without the marker statements and with the variables renamed by the
+// redeclarations (see shadow.go) in their original names.
+func (s *Session) userSource(space bool) (string, error) {
+	main := s.mainFunc()
+	body := *main.Body
+	body.List = nil
+	for _, stmt := range main.Body.List {
+		if _, ok := markerNo(stmt); !ok {
+			body.List = append(body.List, stmt)
+		}
+	}
+
+	orig := main.Body
+	main.Body = &body
+	defer func() {
+		main.Body = orig
+	}()
+
+	source, err := s.source(space)
+	return unshadow(source), err
+}
+
 func (s *Session) reset() error {
 	source, err := s.source(false)
 	if err != nil {
@@ -372,64 +1041,121 @@ func (s *Session) reset() error {
 
 // Eval the input.
 func (s *Session) Eval(in string) error {
+	return s.eval(in, true)
+}
+
+// eval evaluates the input. If run is false, the input is only added to the
+// session without running it.
+func (s *Session) eval(in string, run bool) error {
 	debugf("eval >>> %q", in)
 
+	s.phase = PhaseParse
+
 	s.clearQuickFix()
+	s.reloadChanged()
 	s.storeCode()
 
+	snap, err := s.snapshot()
+	if err != nil {
+		debugf("snapshot :: err = %s", err)
+	}
+
 	if strings.HasPrefix(strings.TrimSpace(in), ":") {
-		err := s.invokeCommand(in)
+		s.phase = PhaseCommand
+		err := s.invokeCommand(in, snap)
 		if err != nil && err != ErrQuit {
 			fmt.Fprintf(s.stderr, "%s\n", err)
 		}
 		return err
 	}
 
+	s.inputNo++
+	s.inputSrcs[s.inputNo] = in
+
 	if _, err := s.evalExpr(in); err != nil {
 		debugf("expr :: err = %s", err)
 
-		err := s.evalStmt(in)
+		err := s.evalDecl(in)
 		if err != nil {
-			debugf("stmt :: err = %s", err)
+			debugf("decl :: err = %s", err)
 
-			err := s.evalFunc(in)
+			err := s.evalStmt(in)
 			if err != nil {
-				debugf("func :: err = %s", err)
+				debugf("stmt :: err = %s", err)
 
-				if err := s.parseTokens(in); err != nil {
-					fmt.Fprintf(s.stderr, "%s\n", err)
-					return err
-				}
+				err := s.evalFunc(in)
+				if err != nil {
+					debugf("func :: err = %s", err)
+
+					s.inputNo--
 
-				return ErrContinue
+					if err := s.parseTokens(in); err != nil {
+						fmt.Fprintf(s.stderr, "%s\n", err)
+						return err
+					}
+
+					return ErrContinue
+				}
 			}
 		}
 	}
 
 	if s.autoImport {
 		s.fixImports()
+		s.recordImports()
 	}
 	s.doQuickFix()
 
-	err := s.Run()
+	if !run {
+		s.inputs = append(s.inputs, sessionInput{no: s.inputNo, src: in})
+		return nil
+	}
+
+	popped := false
+	s.phase = PhaseCompile
+	err = s.Run()
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			// if failed with status 2, remove the last statement
-			if st, ok := exitErr.ProcessState.Sys().(syscall.WaitStatus); ok {
-				if st.ExitStatus() == 2 {
-					debugf("got exit status 2, popping out last input")
-					s.restoreCode()
+		switch e := err.(type) {
+		case *abortError:
+			fmt.Fprintf(s.stderr, "%s\n", e)
+			debugf("run aborted, popping out last input")
+			s.restoreCode()
+			popped = true
+			err = ErrCmdRun
+		case *runError:
+			if e.err == ErrPanic && !s.keepPanicked || e.err == ErrCompile {
+				debugf("%s, popping out last input", e)
+				s.restoreCode()
+				popped = true
+			} else {
+				// the input was kept but its effects were not saved
+				s.statePath = ""
+			}
+			if e.reason != "" {
+				state := "kept"
+				if popped {
+					state = "dropped"
 				}
+				fmt.Fprintf(s.stderr, "%s; the input is %s\n", e, state)
 			}
+			err = e.err
+		default:
+			debugf("%s", err)
+			err = ErrCmdRun
 		}
-		debugf("%s", err)
-		err = ErrCmdRun
+	}
+
+	if !popped {
+		s.inputs = append(s.inputs, sessionInput{no: s.inputNo, src: in})
+		s.pushUndo(snap)
 	}
 
 	return err
 }
 
-func (s *Session) invokeCommand(in string) (err error) {
+// invokeCommand invokes the command in. snap is the state before the command,
+// which can be undone if the command changes the code.
+func (s *Session) invokeCommand(in string, snap *snapshot) (err error) {
 	in = strings.TrimLeftFunc(in, func(c rune) bool {
 		return c == ':' || unicode.IsSpace(c)
 	})
@@ -439,16 +1165,28 @@ func (s *Session) invokeCommand(in string) (err error) {
 	}
 	cmd := tokens[0]
 	arg := strings.TrimSpace(strings.TrimPrefix(in, cmd))
-	for _, command := range commands {
+	for _, command := range s.allCommands() {
 		if !command.name.matches(cmd) {
 			continue
 		}
+		if command.record {
+			// the code added by the command is numbered like an input
+			s.inputNo++
+		}
 		err = command.action(s, arg)
+		if command.record && err != nil {
+			s.inputNo--
+		}
+		if command.undoable {
+			s.pushUndo(snap)
+		}
 		if err != nil {
 			if err == ErrQuit {
 				return
 			}
 			err = fmt.Errorf("%s: %s", command.name, err)
+		} else if command.record {
+			s.inputs = append(s.inputs, sessionInput{no: s.inputNo, src: ":" + in})
 		}
 		return
 	}
@@ -458,29 +1196,38 @@ func (s *Session) invokeCommand(in string) (err error) {
 // storeCode stores current state of code so that it can be restored
 func (s *Session) storeCode() {
 	s.lastStmts = s.mainBody.List
-	if len(s.lastDecls) != len(s.file.Decls) {
-		s.lastDecls = make([]ast.Decl, len(s.file.Decls))
+	s.lastRenames = map[*ast.Ident]string{}
+	s.lastDecls = make([]ast.Decl, len(s.file.Decls))
+	for i, d := range s.file.Decls {
+		if d, ok := d.(*ast.GenDecl); ok {
+			// imports are added to the specs of the existing declaration
+			d := *d
+			d.Specs = append([]ast.Spec(nil), d.Specs...)
+			s.lastDecls[i] = &d
+			continue
+		}
+		s.lastDecls[i] = d
 	}
-	copy(s.lastDecls, s.file.Decls)
+	s.lastImports = append([]*ast.ImportSpec(nil), s.file.Imports...)
 }
 
 // restoreCode restores the previous code
 func (s *Session) restoreCode() {
 	s.mainBody.List = s.lastStmts
-	decls := make([]ast.Decl, 0, len(s.file.Decls))
-	for _, d := range s.file.Decls {
-		if d, ok := d.(*ast.FuncDecl); ok && d.Name.String() != "main" {
-			for _, ld := range s.lastDecls {
-				if ld, ok := ld.(*ast.FuncDecl); ok && ld.Name.String() == d.Name.String() {
-					decls = append(decls, ld)
-					break
-				}
-			}
+	for ident, name := range s.lastRenames {
+		ident.Name = name
+	}
+	// main may have been parsed again, keeping its body
+	decls := make([]ast.Decl, len(s.lastDecls))
+	for i, d := range s.lastDecls {
+		if d, ok := d.(*ast.FuncDecl); ok && declKey(d) == "main" {
+			decls[i] = s.mainFunc()
 			continue
 		}
-		decls = append(decls, d)
+		decls[i] = d
 	}
 	s.file.Decls = decls
+	s.file.Imports = s.lastImports
 }
 
 // includeFiles imports packages and functions from multiple golang source files
@@ -491,22 +1238,9 @@ func (s *Session) includeFiles(files []string) {
 }
 
 func (s *Session) includeFile(file string) {
-	content, err := ioutil.ReadFile(file)
-	if err != nil {
-		errorf("%s", err)
-		return
-	}
-
-	if err = s.importPackages(content); err != nil {
-		errorf("%s", err)
-		return
+	if err := s.includeContext(file); err != nil {
+		s.errorf("%s", err)
 	}
-
-	if err = s.importFile(content); err != nil {
-		errorf("%s", err)
-	}
-
-	infof("added file %s", file)
 }
 
 // importPackages includes packages defined on external file into main file
@@ -534,11 +1268,30 @@ func (s *Session) importFile(src []byte) error {
 
 	ext := tmp.Name() + ".go"
 
-	f, err := parser.ParseFile(s.fset, ext, src, parser.Mode(0))
+	f, err := s.parseContextFile(ext, src)
 	if err != nil {
 		return err
 	}
 
+	if err := writeContextFile(s.fset, ext, f); err != nil {
+		return err
+	}
+
+	debugf("import file: %s", ext)
+	s.extraFilePaths = append(s.extraFilePaths, ext)
+	s.extraFiles = append(s.extraFiles, f)
+
+	return nil
+}
+
+// parseContextFile parses src of a file included by -context
+// as a file of package main.
+func (s *Session) parseContextFile(ext string, src []byte) (*ast.File, error) {
+	f, err := parser.ParseFile(s.fset, ext, src, parser.Mode(0))
+	if err != nil {
+		return nil, err
+	}
+
 	// rewrite to package main
 	f.Name.Name = "main"
 
@@ -555,22 +1308,17 @@ func (s *Session) importFile(src []byte) error {
 		}
 	}
 
+	return f, nil
+}
+
+func writeContextFile(fset *token.FileSet, ext string, f *ast.File) error {
 	out, err := os.Create(ext)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	err = printer.Fprint(out, s.fset, f)
-	if err != nil {
-		return err
-	}
-
-	debugf("import file: %s", ext)
-	s.extraFilePaths = append(s.extraFilePaths, ext)
-	s.extraFiles = append(s.extraFiles, f)
-
-	return nil
+	return printer.Fprint(out, fset, f)
 }
 
 // fixImports formats and adjusts imports for the current AST.
@@ -597,25 +1345,6 @@ func (s *Session) fixImports() error {
 	return nil
 }
 
-func (s *Session) includePackage(path string) error {
-	pkg, err := build.Import(path, ".", 0)
-	if err != nil {
-		var err2 error
-		pkg, err2 = build.ImportDir(path, 0)
-		if err2 != nil {
-			return err // return package path import error, not directory import error as build.Import can also import directories if "./foo" is specified
-		}
-	}
-
-	files := make([]string, len(pkg.GoFiles))
-	for i, f := range pkg.GoFiles {
-		files[i] = filepath.Join(pkg.Dir, f)
-	}
-	s.includeFiles(files)
-
-	return nil
-}
-
 // Clear the temporary directory.
 func (s *Session) Clear() error {
 	return os.RemoveAll(s.tempDir)
@@ -2,8 +2,17 @@ package gore
 
 import (
 	"bytes"
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -153,6 +162,12 @@ func TestSession_IncludePackage(t *testing.T) {
 	defer s.Clear()
 	require.NoError(t, err)
 
+	// the package is found in the module of the working directory
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	err = s.enterModule(wd)
+	require.NoError(t, err)
+
 	err = s.includePackage("github.com/motemen/gore/gocode")
 	require.NoError(t, err)
 
@@ -160,6 +175,144 @@ func TestSession_IncludePackage(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestSession_EnterModule(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.work":               "go 1.21\n\nuse (\n\t./a\n\t./b\n)\n",
+		"a/go.mod":              "module example.com/a\n\ngo 1.21\n",
+		"a/internal/greet/g.go": "package greet\n\nfunc Hello() string { return \"hello\" }\n",
+		"b/go.mod":              "module example.com/b\n\ngo 1.21\n",
+		"b/b.go":                "package b\n\nconst Name = \"b\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	err = s.enterModule(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/a/gore_session", s.modulePath())
+
+	// packages are found from the session module as gore does
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(s.tempDir))
+	defer os.Chdir(wd)
+
+	codes := []string{
+		`:import example.com/a/internal/greet`,
+		`:import example.com/b`,
+		`greet.Hello() + b.Name`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, `"hellob"`+"\n", stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSession_IncludePackage_InPackage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":       "module example.com/p\n\ngo 1.21\n",
+		"p.go":         "package p\n\nvar greeting = \"hello\"\n\nfunc init() { greeting += \"!\" }\n",
+		"p_ignored.go": "//go:build ignore\n\npackage p\n\nvar greeting = 1\n",
+		"p_test.go":    "package p\n\nfunc helper() string { return \"test\" }\n",
+		"cmd/main.go":  "package main\n\nfunc double(n int) int { return n * 2 }\n\nfunc main() { panic(\"not run\") }\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	for _, test := range []struct {
+		dir    string
+		codes  []string
+		stdout string
+		stderr string
+	}{
+		{dir, []string{`greeting`, `helper()`}, `"hello!"` + "\n" + `"test"` + "\n", "evaluating in package example.com/p\n"},
+		{filepath.Join(dir, "cmd"), []string{`double(21)`}, "42\n", "evaluating in package example.com/p/cmd\n"},
+	} {
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		s, err := NewSession(stdout, stderr)
+		defer s.Clear()
+		require.NoError(t, err)
+
+		require.NoError(t, s.enterModule(dir))
+		require.NoError(t, s.includePackage(test.dir))
+
+		// packages are found from the session module as gore does
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+		require.NoError(t, os.Chdir(s.tempDir))
+
+		for _, code := range test.codes {
+			err := s.Eval(code)
+			assert.NoError(t, err)
+		}
+		require.NoError(t, os.Chdir(wd))
+
+		assert.Equal(t, test.stdout, stdout.String())
+		assert.Equal(t, test.stderr, stderr.String())
+	}
+}
+
+func TestSession_ReloadPackage_KeepPrevious(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now()
+	write := func(name, src string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(src), 0644))
+		// the changes are detected by the modification times
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	write("go.mod", "module example.com/p\n\ngo 1.21\n")
+	write("p.go", "package p\n\nfunc Greet() string { return \"hello\" }\n")
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	require.NoError(t, s.enterModule(dir))
+	require.NoError(t, s.includePackage(dir))
+
+	// packages are found from the session module as gore does
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(s.tempDir))
+	defer os.Chdir(wd)
+
+	require.NoError(t, s.Eval(`g := Greet() + "!"`))
+
+	// breaks g; the previous version is kept, without the file added
+	write("p.go", "package p\n")
+	write("q.go", "package p\n\nfunc Greet() int { return 1 }\n")
+	require.NoError(t, s.Eval(`Greet()`))
+	assert.Contains(t, stderr.String(), "error: example.com/p (keeping the previous version):\n")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "q.go")))
+	write("p.go", "package p\n\nfunc Greet() string { return \"hi\" }\n")
+	require.NoError(t, s.Eval(`g + Greet()`))
+
+	assert.Equal(t, `"hello!"
+"hello"
+"hi!hi"
+`, stdout.String())
+	assert.Contains(t, stderr.String(), "reloaded package example.com/p\n")
+}
+
 func TestSessionEval_Copy(t *testing.T) {
 	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
 	s, err := NewSession(stdout, stderr)
@@ -307,6 +460,143 @@ func TestSessionEval_MultipleValues(t *testing.T) {
 	assert.Equal(t, "", stderr.String())
 }
 
+func TestSessionEval_Unwrap(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`:set unwrap on`,
+		`strconv.Atoi("12")`,
+		`strconv.Atoi("x")`,
+		`var n int`,
+		`n = strconv.Atoi("34")`,
+		`m := strconv.Atoi("56")`,
+		`n + m`,
+		`m = strconv.Atoi("y")`,
+		// a lone error is not unwrapped
+		`os.Chdir(".")`,
+		`err := os.Chdir(".")`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `12
+34
+56
+90
+<nil>
+<nil>
+`, stdout.String())
+	assert.Equal(t, `error: strconv.Atoi: parsing "x": invalid syntax (*strconv.NumError)
+  wraps: invalid syntax (*errors.errorString)
+error: strconv.Atoi: parsing "y": invalid syntax (*strconv.NumError)
+  wraps: invalid syntax (*errors.errorString)
+`, regexp.MustCompile(`(?m)^exit status \d+\n`).ReplaceAllString(stderr.String(), ""))
+}
+
+func TestSessionEval_Redeclare(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`x := 1`,
+		`x := x + 1`,
+		`y, x := x, x * 10`,
+		`x + y`,
+		`x := strconv.Itoa(x)`,
+		`:list`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, `1
+2
+2
+20
+22
+"20"
+   #1 x := 1
+   #2 x := x + 1
+   #3 y, x := x, x*10
+   #5 x := strconv.Itoa(x)
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSessionEval_Redeclare_Unused(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`x := 1`,
+		`x := "hello"`,
+		`x`,
+		`n := 1`,
+		`p := &n`,
+		// assigns n, as it declares m
+		`n, m := 5, 6`,
+		`*p + m`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	out := regexp.MustCompile(`0x[0-9a-f]+`).ReplaceAllString(stdout.String(), "0x0")
+	assert.Equal(t, `1
+"hello"
+"hello"
+1
+(*int)(0x0)
+5
+6
+11
+`, out)
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSessionEval_Redeclare_CompileError(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		code string
+		err  error
+	}{
+		{`x := 1`, nil},
+		{`x := nope`, ErrCompile},
+		{`x + 1`, nil},
+		{`x := x * 10`, nil},
+		{`:list`, nil},
+	} {
+		err := s.Eval(tc.code)
+		assert.Equal(t, tc.err, err, tc.code)
+	}
+
+	assert.Equal(t, `1
+2
+10
+   #1 x := 1
+   #4 x := x * 10
+`, stdout.String())
+	assert.Contains(t, stderr.String(), "undefined: nope")
+	assert.NotContains(t, stderr.String(), "undefined: x")
+}
+
 func TestSessionEval_Func(t *testing.T) {
 	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
 	s, err := NewSession(stdout, stderr)
@@ -329,10 +619,10 @@ func TestSessionEval_Func(t *testing.T) {
 	}
 
 	assert.Equal(t, "112\n2400\n204\n", stdout.String())
-	assert.Equal(t, `cannot use "foo" (type string) as type int in return argument
-invalid operation: f() + len(g()) (mismatched types string and int)
-invalid operation: f() * len(g()) (mismatched types string and int)
-cannot use 100 (type int) as type string in return argument
+	assert.Equal(t, `[in #3, col 23] cannot use "foo" (untyped string constant) as int value in return statement
+[in #4, col 1] invalid operation: f() + len(g()) (mismatched types string and int)
+[in #6, col 1] invalid operation: f() * len(g()) (mismatched types string and int)
+[in #7, col 26] cannot use 100 (untyped int constant) as string value in return statement
 `, stderr.String())
 }
 
@@ -359,7 +649,7 @@ func TestSessionEval_TokenError(t *testing.T) {
 	assert.Equal(t, `invalid token: "\\"
 invalid token: "#"
 invalid token: "$"
-invalid token: "~"
+[in #1, col 1] cannot use ~ outside of interface or type constraint (use ^ for bitwise complement)
 `, stderr.String())
 }
 
@@ -384,8 +674,477 @@ func TestSessionEval_CompileError(t *testing.T) {
 	}
 
 	assert.Equal(t, "5\n105\n", stdout.String())
-	assert.Equal(t, `undefined: foo
-invalid argument f() (type int) for len
-invalid operation: f() + g() (mismatched types int and string)
+	assert.Equal(t, `[in #1, col 1] undefined: foo
+[in #4, col 5] invalid argument: f() (value of type int) for built-in len
+[in #6, col 1] invalid operation: f() + g() (mismatched types int and string)
 `, stderr.String())
 }
+
+func TestSessionEval_Persist(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	s.persist = true
+
+	codes := []string{
+		`:import fmt`,
+		`x := 10`,
+		`fmt.Print("hello ")`,
+		`type T struct { A, B int }`,
+		`t := T{A: x}`,
+		`x++`,
+		`t.B = x * 2`,
+		`t`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, `10
+hello 6
+<nil>
+main.T{A:10, B:0}
+22
+main.T{A:10, B:22}
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSessionEval_Persist_Unsaved(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+	s.persist = true
+
+	codes := []string{
+		`:import errors`,
+		`x := 1`,
+		`p := &x`,
+		`*p + 1`,
+		`*p + 2`,
+		`e := errors.New("e")`,
+		`e.Error()`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, strings.Count(stderr.String(), "persist: p cannot be saved; the inputs run again from the start\n"))
+	assert.NotContains(t, stderr.String(), "persist: x")
+	assert.NotContains(t, stderr.String(), "persist: e")
+
+	s.Eval(`:clear`)
+	stderr.Reset()
+	codes = []string{
+		`e := errors.New("e")`,
+		`e.Error()`,
+		`e.Error() + "!"`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, "persist: e cannot be saved; the inputs run again from the start\n", stderr.String())
+}
+
+func TestSessionEval_ReplayedOutput(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`:import fmt`,
+		`fmt.Println("a")`,
+		`fmt.Println("b")`,
+		`:replay on`,
+		`fmt.Println("c")`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, `a
+2
+<nil>
+b
+2
+<nil>
+a
+b
+c
+2
+<nil>
+`, stdout.String())
+	assert.Equal(t, "showing the output of all inputs\n", stderr.String())
+}
+
+func TestSessionEval_Timeout(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	err = s.Eval(":timeout 5s")
+	require.NoError(t, err)
+
+	err = s.Eval("for {}")
+	require.Equal(t, ErrCmdRun, err)
+
+	err = s.Eval("1")
+	require.NoError(t, err)
+
+	assert.Equal(t, "1\n", stdout.String())
+	assert.Equal(t, "timed out after 5s while running input #1\n", stderr.String())
+}
+
+func TestSessionEval_TopLevelDecls(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		code string
+		err  error
+	}{
+		{`type T struct{ S string }`, nil},
+		{`const greeting = "hello"`, nil},
+		{`var t = T{S: greeting}`, nil},
+		{`import "strings"`, nil},
+		{`func (t T) Upper() string { return strings.ToUpper(t.S) }`, nil},
+		{`t.Upper()`, nil},
+		{`const c int = "x"`, ErrCompile},
+		{`1 + 1`, nil},
+		{`type T struct{ S string; N int }`, nil},
+		{`T{N: 1}`, nil},
+		{`type T int`, ErrCompile},
+		{`T{N: 2}.N`, nil},
+		{`n := 3`, nil},
+		{`var m = n * 2`, nil},
+		{`m + n`, nil},
+		{`:define var count int`, nil},
+		{`func inc() int { count++; return count }`, nil},
+		{`var count = 10`, nil},
+		{`inc()`, nil},
+	} {
+		err := s.Eval(tc.code)
+		assert.Equal(t, tc.err, err, tc.code)
+	}
+
+	assert.Equal(t, `"hello"
+main.T{S:"hello"}
+"HELLO"
+2
+main.T{S:"", N:1}
+2
+3
+6
+9
+10
+11
+`, stdout.String())
+	assert.Contains(t, stderr.String(), `cannot use "x"`)
+	assert.NotContains(t, stderr.String(), "redeclared")
+
+	var globals []string
+	for _, decl := range s.file.Decls {
+		if decl, ok := decl.(*ast.GenDecl); ok {
+			globals = append(globals, declKeys(decl)...)
+		}
+	}
+	assert.Contains(t, globals, `"strings"`)
+	assert.Contains(t, globals, "T")
+	assert.Contains(t, globals, "greeting")
+	assert.Contains(t, globals, "count")
+	assert.NotContains(t, globals, "t")
+	assert.NotContains(t, globals, "m")
+}
+
+func TestWithoutNames(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", `package p
+type T struct{ A int }
+type U struct{ T int }
+var a, b = 1, 2
+var (
+	x = 1
+	y = 2
+)
+const (
+	A = iota
+	B
+	C
+)
+func T2() {}
+`, 0)
+	require.NoError(t, err)
+
+	redeclared := func(name string) bool {
+		return name == "A" || name == "T" || name == "a" || name == "x" || name == "y" || name == "B"
+	}
+	var decls []string
+	for _, d := range f.Decls {
+		if d := withoutNames(d, redeclared); d != nil {
+			decls = append(decls, showNode(fset, d))
+		}
+	}
+	assert.Equal(t, []string{
+		"type U struct{ T int }",
+		"var _, b = 1, 2",
+		"const (\n\t_\t= iota\n\t_\n\tC\n)",
+		"func T2()\t{}",
+	}, decls)
+}
+
+func TestSessionEval_Methods(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`type A int`,
+		`type B string`,
+		`func (a A) String() string { return fmt.Sprint("A", int(a)) }`,
+		`func (b *B) String() string { return "B:" + string(*b) }`,
+		`b := B("x")`,
+		`fmt.Sprint(A(1), &b)`,
+		`func (a *A) String() string { return "A2" }`,
+		`a := A(1)`,
+		`fmt.Sprint(a, &a, &b)`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, `"x"
+"A1 B:x"
+1
+"1 A2 B:x"
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSessionEval_Generics(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`func Map[T, U any](xs []T, f func(T) U) []U { var r []U; for _, x := range xs { r = append(r, f(x)) }; return r }`,
+		`type Pair[K comparable, V any] struct { Key K; Val V }`,
+		`func (p Pair[K, V]) String() string { return fmt.Sprint(p.Key, "=", p.Val) }`,
+		`xs := []int{1, 2, 3}`,
+		`Map[int, string](xs, func(i int) string { return fmt.Sprint(i * 2) })`,
+		`Map(xs, func(i int) int { return i + 1 })`,
+		`p := Pair[string, int]{"a", 1}`,
+		`p.String()`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, `[]int{1, 2, 3}
+[]string{"2", "4", "6"}
+[]int{2, 3, 4}
+main.Pair[string,int]{Key:"a", Val:1}
+"a=1"
+`, stdout.String())
+	assert.Equal(t, "", stderr.String())
+}
+
+func TestSessionEval_Wait(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		`:set wait 200ms`,
+		`ch := make(chan int); go func() { ch <- 1 }()`,
+		`println(<-ch)`,
+	}
+
+	for _, code := range codes {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+
+	err = s.Eval(`println(<-ch)`)
+	assert.Equal(t, ErrCmdRun, err)
+	assert.Contains(t, stderr.String(), "deadlock while running input #3\n")
+
+	for _, code := range []string{`:import fmt`, `:import time`} {
+		err := s.Eval(code)
+		require.NoError(t, err)
+	}
+	err = s.Eval(`_ = time.AfterFunc(10*time.Millisecond, func() { fmt.Println("fired") })`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fired\n", stdout.String())
+	assert.Contains(t, stderr.String(), "gore: goroutines still running after 200ms:\n    #1 main.main.func1\n")
+	assert.Contains(t, stderr.String(), "fatal error: all goroutines are asleep - deadlock!")
+}
+
+func TestSessionEval_SourceMap(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes := []string{
+		"func f(n int) int {\n\tif n == 0 {\n\t\tpanic(\"zero\")\n\t}\n\treturn n\n}",
+		`x := f(1)`,
+		`y := "a"; y+x`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, "1\n", stdout.String())
+	assert.Equal(t, "[in #3, col 11] invalid operation: y + x (mismatched types string and int)\n", stderr.String())
+
+	stdout.Reset()
+	stderr.Reset()
+	s, err = NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	codes = []string{
+		codes[0],
+		`x := f(1)`,
+		`x = f(0) + x`,
+	}
+
+	for _, code := range codes {
+		_ = s.Eval(code)
+	}
+
+	assert.Equal(t, "1\n", stdout.String())
+	assert.Regexp(t, `^panic: zero
+
+goroutine 1 \[running\]:
+main.f\(.*\)
+	\[in #1, line 3\]
+main.main\(\)
+	\[in #3\]
+panicked while running input #3; the input is dropped
+$`, stderr.String())
+}
+
+func TestSessionEval_Failures(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		code string
+		err  error
+	}{
+		{`foo()`, ErrCompile},
+		{`panic("drop")`, ErrPanic},
+		{`:set onpanic keep`, nil},
+		{`panic("keep")`, ErrPanic},
+		{`:list`, nil},
+		{`:rm 3`, nil},
+		{`:set onpanic drop`, nil},
+		{`:import os`, nil},
+		{`os.Exit(1)`, ErrExit},
+		{`:list`, nil},
+		{`:rm 5`, nil},
+		// not a panic without the trace of the runtime
+		{`os.Stderr.WriteString("panic: not really\n"); os.Exit(2)`, ErrExit},
+	} {
+		err := s.Eval(tc.code)
+		assert.Equal(t, tc.err, err, tc.code)
+	}
+
+	assert.Equal(t, "   #3 panic(\"keep\")\n   #4 import \"os\"\n   #5 os.Exit(1)\n", stdout.String())
+	assert.Contains(t, stderr.String(), "[in #1, col 1] undefined: foo\n")
+	assert.Contains(t, stderr.String(), "panicked while running input #2; the input is dropped\n")
+	assert.Contains(t, stderr.String(), "panicked while running input #3; the input is kept\n")
+	assert.Contains(t, stderr.String(), "exited with status 1 while running input #5; the input is kept\n")
+	assert.Contains(t, stderr.String(), "exited with status 2 while running input #6; the input is kept\n")
+	assert.Equal(t, "input #3 failed", (&runError{err: ErrPanic, input: 3}).Error())
+}
+
+func TestSessionEvalContext(t *testing.T) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	s, err := NewSession(stdout, stderr)
+	defer s.Clear()
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	r := s.EvalContext(ctx, `type T struct{ X int }`)
+	require.NoError(t, r.Err)
+	assert.Empty(t, r.Values)
+
+	r = s.EvalContext(ctx, `var x = 40 + 2`)
+	require.NoError(t, r.Err)
+	assert.Equal(t, PhaseRun, r.Phase)
+	assert.Equal(t, "42\n", r.Stdout)
+	assert.Equal(t, []Value{{Expr: "x", Type: "int", Repr: "42"}}, r.Values)
+
+	r = s.EvalContext(ctx, `var a, b = T{x}, "b"`)
+	require.NoError(t, r.Err)
+	assert.Equal(t, []Value{
+		{Expr: "a", Type: "T", Repr: "main.T{X:42}"},
+		{Expr: "b", Type: "string", Repr: `"b"`},
+	}, r.Values)
+
+	r = s.EvalContext(ctx, `len(b) + 1`)
+	require.NoError(t, r.Err)
+	assert.Equal(t, []Value{{Expr: "len(b) + 1", Type: "int", Repr: "2"}}, r.Values)
+
+	r = s.EvalContext(ctx, `T{x}, len(b)`)
+	assert.Equal(t, PhaseParse, r.Phase)
+	assert.Equal(t, ErrContinue, r.Err)
+
+	r = s.EvalContext(ctx, `:print`)
+	require.NoError(t, r.Err)
+	assert.Equal(t, PhaseCommand, r.Phase)
+	assert.Contains(t, r.Stdout, "package main")
+	assert.Empty(t, r.Values)
+
+	r = s.EvalContext(ctx, `foo()`)
+	assert.Equal(t, ErrCompile, r.Err)
+	assert.Equal(t, PhaseCompile, r.Phase)
+	assert.Contains(t, r.Stderr, "undefined: foo")
+
+	r = s.EvalContext(ctx, `println(a.X); panic(b)`)
+	assert.Equal(t, ErrPanic, r.Err)
+	assert.Equal(t, PhaseRun, r.Phase)
+	assert.Contains(t, r.Stderr, "42\npanic: b")
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	r = s.EvalContext(timeout, `for {}`)
+	assert.Equal(t, context.DeadlineExceeded, r.Err)
+	assert.Contains(t, r.Stderr, "context deadline exceeded while running input #")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	r = s.EvalContext(canceled, `a`)
+	assert.Equal(t, context.Canceled, r.Err)
+
+	assert.Contains(t, stdout.String(), "42\n")
+	assert.Contains(t, stderr.String(), "undefined: foo")
+}
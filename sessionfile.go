@@ -0,0 +1,276 @@
+package gore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// sessionFile is the format of files written by :save and read by :load
+// (or the -session flag). It is a JSON object like:
+//
+//	{
+//	  "version": 1,
+//	  "options": {
+//	    "autoimport": false,
+//	    "persist": true,
+//	    "replay": false,
+//	    "timeout": "10s",
+//	    "wait": "1s",
+//	    "limits": "mem=512M cpu=off files=off procs=off",
+//	    "lang": "go1.21"
+//	  },
+//	  "context": ["/home/you/helpers.go"],
+//	  "inputs": [
+//	    ":import fmt",
+//	    "x := 1",
+//	    "func f() int { return x }"
+//	  ]
+//	}
+//
+// inputs are the accepted inputs in the order they were entered, including
+// the commands which change the code (:import, :define and :get).
+// context are the files and the packages included by -context or :load,
+// by their absolute paths, or by their import paths unless copied into the
+// session, and package is the directory of the package of -pkg.
+// Loading a session includes them unless included already, and evaluates
+// the inputs in order with the options applied.
+type sessionFile struct {
+	Version int            `json:"version"`
+	Options sessionOptions `json:"options"`
+	Context []string       `json:"context,omitempty"`
+	Package string         `json:"package,omitempty"`
+	Inputs  []string       `json:"inputs"`
+}
+
+type sessionOptions struct {
+	AutoImport bool   `json:"autoimport"`
+	Persist    bool   `json:"persist"`
+	Replay     bool   `json:"replay"`
+	Unwrap     bool   `json:"unwrap,omitempty"`
+	OnPanic    string `json:"onpanic,omitempty"`
+	Timeout    string `json:"timeout,omitempty"`
+	Wait       string `json:"wait,omitempty"`
+	Limits     string `json:"limits,omitempty"`
+	Lang       string `json:"lang,omitempty"`
+}
+
+const sessionFileVersion = 1
+
+func (s *Session) options() sessionOptions {
+	o := sessionOptions{
+		AutoImport: s.autoImport,
+		Persist:    s.persist,
+		Replay:     s.replayOutput,
+		Unwrap:     s.unwrap,
+		Lang:       s.lang,
+	}
+	if s.keepPanicked {
+		o.OnPanic = s.onPanic()
+	}
+	if s.timeout > 0 {
+		o.Timeout = s.timeout.String()
+	}
+	if s.wait > 0 {
+		o.Wait = s.wait.String()
+	}
+	if s.limits != (limits{}) {
+		o.Limits = s.limits.String()
+	}
+	return o
+}
+
+func (s *Session) setOptions(o sessionOptions) error {
+	var timeout time.Duration
+	if o.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(o.Timeout)
+		if err != nil {
+			return fmt.Errorf("timeout: %s", err)
+		}
+	}
+
+	var wait time.Duration
+	if o.Wait != "" {
+		var err error
+		wait, err = time.ParseDuration(o.Wait)
+		if err != nil {
+			return fmt.Errorf("wait: %s", err)
+		}
+	}
+
+	var l limits
+	if o.Limits != "" {
+		if err := l.set(o.Limits); err != nil {
+			return fmt.Errorf("limits: %s", err)
+		}
+	}
+
+	keepPanicked := o.OnPanic == "keep"
+	if o.OnPanic != "" && o.OnPanic != "keep" && o.OnPanic != "drop" {
+		return fmt.Errorf("onpanic: invalid value: %s", o.OnPanic)
+	}
+
+	if err := s.setLang(o.Lang); err != nil {
+		return fmt.Errorf("lang: %s", err)
+	}
+
+	s.autoImport = o.AutoImport
+	s.persist = o.Persist
+	s.replayOutput = o.Replay
+	s.unwrap = o.Unwrap
+	s.keepPanicked = keepPanicked
+	s.timeout = timeout
+	s.wait = wait
+	s.limits = l
+
+	return nil
+}
+
+// save writes the session to filename.
+func (s *Session) save(filename string) error {
+	if s.edited {
+		return fmt.Errorf("cannot save a session modified by :edit; use :write instead")
+	}
+
+	inputs := make([]string, len(s.inputs))
+	for i, in := range s.inputs {
+		inputs[i] = in.src
+	}
+
+	context, err := s.contextPaths()
+	if err != nil {
+		return err
+	}
+	var pkg string
+	if s.pkg != nil {
+		pkg = s.pkg.Dir
+	}
+
+	b, err := json.MarshalIndent(sessionFile{
+		Version: sessionFileVersion,
+		Options: s.options(),
+		Context: context,
+		Package: pkg,
+		Inputs:  inputs,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// load replaces the session with the one saved in filename.
+// The inputs are added to the session and then run all at once.
+// If it fails, the session is restored as it was before.
+func (s *Session) load(filename string) (err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var sf sessionFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	if sf.Version != sessionFileVersion {
+		return fmt.Errorf("%s: unsupported version: %d", filename, sf.Version)
+	}
+
+	if sf.Package != "" && s.pkg != nil && s.pkg.Dir != sf.Package {
+		return fmt.Errorf("%s: saved in package %s, not in %s", filename, sf.Package, s.pkg.Dir)
+	}
+
+	snap, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	options, inputSrcs, undoStack, redoStack := s.options(), s.inputSrcs, s.undoStack, s.redoStack
+	defer func() {
+		if err == nil {
+			return
+		}
+		if e := s.setOptions(options); e != nil {
+			debugf("load :: setOptions: %s", e)
+		}
+		if e := s.restore(snap); e != nil {
+			debugf("load :: restore: %s", e)
+		}
+		s.inputSrcs, s.undoStack, s.redoStack = inputSrcs, undoStack, redoStack
+	}()
+
+	// files and packages included by -context or -pkg are kept
+	extraFilePaths, extraFiles, contexts, contextPkgs := s.extraFilePaths, s.extraFiles, s.contexts, s.contextPkgs
+	if err := s.init(); err != nil {
+		return err
+	}
+	s.extraFilePaths, s.extraFiles, s.contexts, s.contextPkgs = extraFilePaths, extraFiles, contexts, contextPkgs
+	for _, p := range contextPkgs {
+		s.importContextPackage(p)
+	}
+
+	// modules are required again by :get in the inputs
+	s.requires = nil
+
+	if err := s.setOptions(sf.Options); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	if sf.Package != "" && s.pkg == nil {
+		if err := s.includePackage(sf.Package); err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	included, err := s.contextPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range sf.Context {
+		if !containsString(included, path) {
+			if err := s.includeContext(path); err != nil {
+				return fmt.Errorf("%s: %s", filename, err)
+			}
+		}
+	}
+
+	for i, in := range sf.Inputs {
+		if err := s.eval(in, false); err != nil {
+			return fmt.Errorf("%s: input %d: %s", filename, i+1, err)
+		}
+	}
+
+	return s.run(false)
+}
+
+// contextPaths returns the paths of the files and the packages included
+// by -context or :load, as they are saved.
+func (s *Session) contextPaths() ([]string, error) {
+	var paths []string
+	for _, c := range s.contexts {
+		path, err := filepath.Abs(c.path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	for _, p := range s.contextPkgs {
+		if p.copyDir != "" {
+			paths = append(paths, p.dir)
+		} else {
+			paths = append(paths, p.importPath)
+		}
+	}
+	return paths, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
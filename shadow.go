@@ -0,0 +1,178 @@
+package gore
+
+import (
+	"fmt"
+	"regexp"
+
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Redeclaration
+//
+// The statements of all the inputs are in the body of main, where a name
+// cannot be declared twice. When an input declares a name by := or var
+// which an earlier input has declared, the earlier variable is renamed
+// in the statements before the input, so that they keep referring to it
+// while the input and the later ones refer to the new variable, as if every
+// input were in a scope nested in the previous ones. A := which declares a
+// new name as well assigns the earlier variables as in Go. The renamed
+// variables are shown with their original names by :list. The renames are
+// undone by restoreCode when the input is dropped.
+
+// shadowedName returns the new name of the variable name redeclared
+// by the input numbered inputNo.
+func shadowedName(name string, inputNo int) string {
+	return fmt.Sprintf("__gore_%s_%d", name, inputNo)
+}
+
+var shadowedNameRegexp = regexp.MustCompile(`\b__gore_(\w+?)_\d+\b`)
+
+// unshadow replaces the names of the renamed variables in src
+// with their original names.
+func unshadow(src string) string {
+	return shadowedNameRegexp.ReplaceAllString(src, "$1")
+}
+
+// shadowRedeclared renames the variables of main which stmts, the statements
+// of the input appended to main, declare again. The uses of the variables
+// in stmts before they are declared again are renamed too, as in x := x + 1.
+func (s *Session) shadowRedeclared(stmts []ast.Stmt) {
+	isNew := map[ast.Stmt]bool{}
+	for _, stmt := range stmts {
+		isNew[stmt] = true
+	}
+
+	declared := map[string]bool{}
+	for _, stmt := range s.mainBody.List {
+		if isNew[stmt] {
+			break
+		}
+		for _, name := range definedNames(stmt) {
+			declared[name] = true
+		}
+	}
+	redeclared := map[string]bool{}
+	for _, stmt := range stmts {
+		for _, ident := range redeclaringIdents(stmt, declared) {
+			redeclared[ident.Name] = true
+		}
+	}
+	if len(redeclared) == 0 {
+		return
+	}
+
+	info := types.Info{
+		Defs:   map[*ast.Ident]types.Object{},
+		Uses:   map[*ast.Ident]types.Object{},
+		Scopes: map[ast.Node]*types.Scope{},
+	}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	conf.Check("main", s.fset, append(s.checkFiles(), s.file), &info)
+
+	mainScope := info.Scopes[s.mainFunc().Type]
+	if mainScope == nil {
+		return
+	}
+
+	renamed := map[types.Object]string{}
+	for name := range redeclared {
+		if obj := mainScope.Lookup(name); obj != nil {
+			renamed[obj] = shadowedName(name, s.inputNo)
+		}
+	}
+
+	// rename renames the identifiers in node referring to the renamed
+	// variables, except those in skip and those whose names are in rebound.
+	rename := func(node ast.Node, skip map[*ast.Ident]bool, rebound map[string]bool) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok || skip[ident] || rebound[ident.Name] {
+				return true
+			}
+			obj := info.Defs[ident]
+			if obj == nil {
+				obj = info.Uses[ident]
+			}
+			if name, ok := renamed[obj]; ok {
+				if _, ok := s.lastRenames[ident]; !ok {
+					s.lastRenames[ident] = ident.Name
+				}
+				ident.Name = name
+			}
+			return true
+		})
+	}
+
+	rebound := map[string]bool{}
+	for _, stmt := range s.mainBody.List {
+		if !isNew[stmt] {
+			rename(stmt, nil, nil)
+			continue
+		}
+		idents := redeclaringIdents(stmt, declared)
+		skip := map[*ast.Ident]bool{}
+		for _, ident := range idents {
+			skip[ident] = true
+		}
+		rename(stmt, skip, rebound)
+		for _, ident := range idents {
+			rebound[ident.Name] = true
+		}
+	}
+
+	// the saved values are of the previous variables
+	s.statePath = ""
+}
+
+// redeclaringIdents returns the identifiers of the names in declared which
+// stmt declares again. A := declaring a new name assigns the others as in Go,
+// so it declares none of them again.
+func redeclaringIdents(stmt ast.Stmt, declared map[string]bool) []*ast.Ident {
+	idents := definedIdents(stmt)
+	if _, ok := stmt.(*ast.AssignStmt); ok {
+		for _, ident := range idents {
+			if ident.Name != "_" && !declared[ident.Name] {
+				return nil
+			}
+		}
+	}
+
+	var redeclaring []*ast.Ident
+	for _, ident := range idents {
+		if declared[ident.Name] {
+			redeclaring = append(redeclaring, ident)
+		}
+	}
+	return redeclaring
+}
+
+// definedIdents returns the identifiers of the names a statement in main
+// declares (see definedNames).
+func definedIdents(stmt ast.Stmt) []*ast.Ident {
+	var idents []*ast.Ident
+	switch stmt := stmt.(type) {
+	case *ast.AssignStmt:
+		if stmt.Tok == token.DEFINE {
+			for _, lhs := range stmt.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok {
+					idents = append(idents, ident)
+				}
+			}
+		}
+	case *ast.DeclStmt:
+		if decl, ok := stmt.Decl.(*ast.GenDecl); ok {
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					idents = append(idents, spec.Names...)
+				case *ast.TypeSpec:
+					idents = append(idents, spec.Name)
+				}
+			}
+		}
+	}
+	return idents
+}
@@ -0,0 +1,267 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+)
+
+// Source map
+//
+// The compiler and the runtime refer to lines and columns of the generated
+// gore_session.go, which mean little to the user. When the session file is
+// printed for a run, the tokens of each input in the file are matched to those
+// in the source of the input, so that the positions in the generated file are
+// mapped to the lines and columns in the inputs as they were entered, although
+// the inputs are formatted and modified in the file. The error filter
+// (see errfilter.go) rewrites compile errors like
+//
+//	./gore_session.go:52:5: undefined: foo
+//
+// into "[in #12, col 5] undefined: foo", and the locations in the stack traces
+// of panics into "[in #12]", hiding the frames of the gore helpers.
+
+// sourcePos is a position in an input. col is 0 if unknown.
+type sourcePos struct {
+	input, line, col int
+}
+
+func (p sourcePos) String() string {
+	s := fmt.Sprintf("in #%d", p.input)
+	if p.line > 1 {
+		s += fmt.Sprintf(", line %d", p.line)
+	}
+	if p.col > 0 {
+		s += fmt.Sprintf(", col %d", p.col)
+	}
+	return s
+}
+
+// sourceMap maps positions in the generated file to those in the inputs.
+type sourceMap struct {
+	// lines holds the tokens on each line of the generated file
+	// which are matched to the inputs, in the order of their columns.
+	lines map[int][]sourceMapEntry
+}
+
+type sourceMapEntry struct {
+	col int
+	pos sourcePos
+}
+
+// lookup returns the position in the input of line and col in the generated
+// file. If col is 0, only the input and the line are looked up.
+func (m *sourceMap) lookup(line, col int) (sourcePos, bool) {
+	if m == nil {
+		return sourcePos{}, false
+	}
+	entries := m.lines[line]
+	if len(entries) == 0 {
+		return sourcePos{}, false
+	}
+	if col <= 0 {
+		pos := entries[0].pos
+		pos.col = 0
+		return pos, true
+	}
+
+	e := entries[0]
+	for _, entry := range entries[1:] {
+		if entry.col > col {
+			break
+		}
+		e = entry
+	}
+	pos := e.pos
+	if col > e.col {
+		// after a token, assuming the rest is written as printed
+		pos.col += col - e.col
+	}
+	return pos, true
+}
+
+// printFile prints file, the session file to run, to w and records
+// the source map of it.
+func (s *Session) printFile(w io.Writer, file *ast.File) error {
+	// main is not printed in a line even if short, so that the lines
+	// in stack traces tell the inputs; the printer puts a block in a line
+	// only if its braces are in a line
+	f := *file
+	f.Decls = append([]ast.Decl{}, file.Decls...)
+	for i, decl := range f.Decls {
+		if decl, ok := decl.(*ast.FuncDecl); ok && decl.Name.Name == "main" && decl.Recv == nil {
+			main, body := *decl, *decl.Body
+			body.Rbrace = file.Package
+			main.Body = &body
+			f.Decls[i] = &main
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, s.fset, &f); err != nil {
+		return err
+	}
+
+	s.srcMap = s.newSourceMap(buf.Bytes())
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// newSourceMap builds the source map of src, the printed session file.
+// The tokens of each input in src are matched to those of the source of the
+// input, which may differ by the formatting and the code added by gore.
+func (s *Session) newSourceMap(src []byte) *sourceMap {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "gore_session.go", src, parser.Mode(0))
+	if err != nil {
+		debugf("newSourceMap :: err = %s", err)
+		return nil
+	}
+	file := fset.File(f.Pos())
+
+	type region struct {
+		input      int
+		start, end token.Pos
+	}
+	var regions []region
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Name.Name != "main" || decl.Recv != nil {
+				regions = append(regions, region{s.declInputs[declKey(decl)], decl.Pos(), decl.End()})
+				continue
+			}
+			n, start := 0, token.NoPos
+			for _, stmt := range decl.Body.List {
+				if no, ok := markerNo(stmt); ok {
+					regions = append(regions, region{n, start, stmt.Pos()})
+					n, start = no, stmt.End()
+				}
+			}
+			regions = append(regions, region{n, start, decl.Body.Rbrace})
+
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				var n int
+				if keys := declKeys(&ast.GenDecl{Tok: decl.Tok, Specs: []ast.Spec{spec}}); len(keys) > 0 {
+					n = s.declInputs[keys[0]]
+				}
+				regions = append(regions, region{n, spec.Pos(), spec.End()})
+			}
+		}
+	}
+
+	m := &sourceMap{lines: map[int][]sourceMapEntry{}}
+	for _, r := range regions {
+		in, ok := s.inputSrcs[r.input]
+		if r.input <= 0 || !ok {
+			continue
+		}
+
+		base := file.Offset(r.start)
+		genTokens := scanTokens(src[base:file.Offset(r.end)])
+		inTokens := scanTokens([]byte(in))
+		for _, match := range matchTokens(genTokens, inTokens) {
+			gen := file.Position(file.Pos(base + match[0].offset))
+			line, col := 1, match[1].offset+1
+			if i := strings.LastIndexByte(in[:match[1].offset], '\n'); i >= 0 {
+				line, col = strings.Count(in[:i+1], "\n")+1, match[1].offset-i
+			}
+			m.lines[gen.Line] = append(m.lines[gen.Line], sourceMapEntry{
+				col: gen.Column,
+				pos: sourcePos{input: r.input, line: line, col: col},
+			})
+		}
+	}
+
+	return m
+}
+
+// srcToken is a token in a source at offset.
+type srcToken struct {
+	offset int
+	tok    token.Token
+	lit    string
+}
+
+// scanTokens returns the tokens in src except for semicolons, which are
+// usually omitted, and the names of the helpers of the session.
+func scanTokens(src []byte) []srcToken {
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(src))
+	sc.Init(file, src, nil, 0)
+
+	var tokens []srcToken
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON || tok == token.IDENT && isScaffoldName(lit) {
+			continue
+		}
+		if tok == token.IDENT {
+			lit = unshadow(lit)
+		}
+		tokens = append(tokens, srcToken{offset: file.Offset(pos), tok: tok, lit: lit})
+	}
+	return tokens
+}
+
+// isScaffoldName reports whether name is of the code added to the inputs.
+func isScaffoldName(name string) bool {
+	switch name {
+	case waitLabelName, waitName, afterFuncName, valuesName:
+		return true
+	}
+	return isHelperName(name) || strings.HasPrefix(name, errVarPrefix)
+}
+
+// matchTokens returns the pairs of the tokens of a and b in their longest
+// common subsequence.
+func matchTokens(a, b []srcToken) [][2]srcToken {
+	equal := func(x, y srcToken) bool {
+		return x.tok == y.tok && x.lit == y.lit
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if equal(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var matches [][2]srcToken
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case equal(a[i], b[j]):
+			matches = append(matches, [2]srcToken{a[i], b[j]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
@@ -0,0 +1,210 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+)
+
+// snapshot is a state of the session which :undo and :redo go back and forth.
+// The code is kept as source so that later modifications of the AST
+// (e.g. by quickfix or astutil.AddImport) do not affect it, and the included
+// files and packages are kept as copies so that a restored one whose file has
+// changed since is reloaded.
+type snapshot struct {
+	fset           *token.FileSet
+	source         string
+	extraFilePaths []string
+	extraFiles     []*ast.File
+	extraSources   []string
+	contexts       []contextFile
+	contextPkgs    []contextPackage
+	requires       []requirement
+	pkg            *targetPackage
+	kept           map[string]string
+	inputNo        int
+	inputs         []sessionInput
+	declInputs     map[string]int
+	edited         bool
+}
+
+// snapshot takes a snapshot of the current session.
+func (s *Session) snapshot() (*snapshot, error) {
+	// not s.source, which clears the positions in main
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, s.fset, s.file); err != nil {
+		return nil, err
+	}
+
+	extraSources := make([]string, len(s.extraFiles))
+	for i, f := range s.extraFiles {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, s.fset, f); err != nil {
+			return nil, err
+		}
+		extraSources[i] = buf.String()
+	}
+
+	contexts := make([]contextFile, len(s.contexts))
+	for i, c := range s.contexts {
+		contexts[i] = *c
+	}
+	contextPkgs := make([]contextPackage, len(s.contextPkgs))
+	for i, p := range s.contextPkgs {
+		contextPkgs[i] = *p
+	}
+	var pkg *targetPackage
+	if s.pkg != nil {
+		p := *s.pkg
+		pkg = &p
+	}
+
+	declInputs := make(map[string]int, len(s.declInputs))
+	for key, no := range s.declInputs {
+		declInputs[key] = no
+	}
+	kept := make(map[string]string, len(s.kept))
+	for path, saved := range s.kept {
+		kept[path] = saved
+	}
+
+	return &snapshot{
+		fset:           s.fset,
+		source:         buf.String(),
+		extraFilePaths: append([]string{}, s.extraFilePaths...),
+		extraFiles:     append([]*ast.File{}, s.extraFiles...),
+		extraSources:   extraSources,
+		contexts:       contexts,
+		contextPkgs:    contextPkgs,
+		requires:       append([]requirement{}, s.requires...),
+		pkg:            pkg,
+		kept:           kept,
+		inputNo:        s.inputNo,
+		inputs:         append([]sessionInput{}, s.inputs...),
+		declInputs:     declInputs,
+		edited:         s.edited,
+	}, nil
+}
+
+// restore replaces the session with the snapshot.
+func (s *Session) restore(snap *snapshot) error {
+	file, err := parser.ParseFile(snap.fset, "gore_session.go", snap.source, parser.Mode(0))
+	if err != nil {
+		return err
+	}
+
+	s.fset = snap.fset
+	s.file = file
+	s.mainBody = s.mainFunc().Body
+	s.extraFilePaths = append([]string{}, snap.extraFilePaths...)
+	s.extraFiles = append([]*ast.File{}, snap.extraFiles...)
+	s.contexts = make([]*contextFile, len(snap.contexts))
+	for i := range snap.contexts {
+		c := snap.contexts[i]
+		s.contexts[i] = &c
+	}
+	s.contextPkgs = make([]*contextPackage, len(snap.contextPkgs))
+	for i := range snap.contextPkgs {
+		p := snap.contextPkgs[i]
+		s.contextPkgs[i] = &p
+	}
+	s.pkg = nil
+	if snap.pkg != nil {
+		p := *snap.pkg
+		s.pkg = &p
+	}
+	s.kept = make(map[string]string, len(snap.kept))
+	for path, saved := range snap.kept {
+		s.kept[path] = saved
+	}
+	s.requires = append([]requirement{}, snap.requires...)
+	if err := s.writeGoMod(); err != nil {
+		return err
+	}
+	s.types.Importer = s.newImporter()
+	s.inputNo = snap.inputNo
+	s.inputs = append([]sessionInput{}, snap.inputs...)
+	s.declInputs = make(map[string]int, len(snap.declInputs))
+	for key, no := range snap.declInputs {
+		s.declInputs[key] = no
+	}
+	s.edited = snap.edited
+
+	// the renames refer to the identifiers of the code replaced
+	s.lastStmts = nil
+	s.lastDecls = nil
+	s.lastRenames = map[*ast.Ident]string{}
+
+	// the saved state may contain the effects of undone inputs
+	s.statePath = ""
+
+	return nil
+}
+
+// pushUndo records snap, the state before the latest change, to be undone.
+func (s *Session) pushUndo(snap *snapshot) {
+	if snap == nil {
+		return
+	}
+
+	if current, err := s.snapshot(); err == nil && current.equal(snap) {
+		// nothing has changed
+		return
+	}
+
+	s.undoStack = append(s.undoStack, snap)
+	s.redoStack = nil
+}
+
+// equal reports whether snap and other hold the same code
+// with the same files, packages and modules.
+func (snap *snapshot) equal(other *snapshot) bool {
+	return snap.source == other.source &&
+		reflect.DeepEqual(snap.extraSources, other.extraSources) &&
+		reflect.DeepEqual(snap.contexts, other.contexts) &&
+		reflect.DeepEqual(snap.contextPkgs, other.contextPkgs) &&
+		reflect.DeepEqual(snap.requires, other.requires) &&
+		(snap.pkg == nil) == (other.pkg == nil) &&
+		(snap.pkg == nil || snap.pkg.Dir == other.pkg.Dir)
+}
+
+// undo goes back n changes.
+func (s *Session) undo(n int) error {
+	return s.travel(n, &s.undoStack, &s.redoStack, "undo")
+}
+
+// redo goes forward n changes undone by undo.
+func (s *Session) redo(n int) error {
+	return s.travel(n, &s.redoStack, &s.undoStack, "redo")
+}
+
+func (s *Session) travel(n int, from, to *[]*snapshot, what string) error {
+	if len(*from) == 0 {
+		return fmt.Errorf("nothing to %s", what)
+	}
+	if n > len(*from) {
+		return fmt.Errorf("only %d change(s) to %s", len(*from), what)
+	}
+
+	for i := 0; i < n; i++ {
+		current, err := s.snapshot()
+		if err != nil {
+			return err
+		}
+
+		snap := (*from)[len(*from)-1]
+		if err := s.restore(snap); err != nil {
+			return err
+		}
+
+		*from = (*from)[:len(*from)-1]
+		*to = append(*to, current)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package gore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Unwrapping results
+//
+// With -unwrap (or :set unwrap on), the results of functions returning
+// values and an error as the last one are unwrapped; a lone error is
+// printed as usual. Evaluating os.ReadFile("x") prints the
+// content if the error is nil, and otherwise the error and the errors it
+// wraps (see errors.Unwrap) to stderr. b := os.ReadFile("x") binds only the
+// content, and if the error is not nil it is reported and the input is
+// dropped as if it panicked.
+//
+// Printed expressions are given to unwrapPrinterName instead of printerName
+// once they are type-checked, and doQuickFix fixes assignments of one value
+// less than the results to assign the error to a new variable, which is
+// checked by checkErrName.
+
+const errVarPrefix = "__gore_err"
+
+var errorType = types.Universe.Lookup("error").Type()
+
+// returnsError reports whether t is the type of a call returning two or
+// more results whose last one is an error.
+func returnsError(t types.Type) bool {
+	tuple, ok := t.(*types.Tuple)
+	return ok && tuple.Len() > 1 && types.Identical(tuple.At(tuple.Len()-1).Type(), errorType)
+}
+
+// unwrapPrinted makes the printed expressions of the latest input which
+// return an error unwrapped when printed.
+func (s *Session) unwrapPrinted() {
+	for _, stmt := range s.mainBody.List {
+		exprs := printedExprs(stmt)
+		if len(exprs) != 1 || !returnsError(s.typeInfo.TypeOf(exprs[0])) {
+			continue
+		}
+		call := stmt.(*ast.ExprStmt).X.(*ast.CallExpr)
+		call.Fun = ast.NewIdent(unwrapPrinterName)
+	}
+}
+
+// unwrapAssign fixes the assignment at pos in main, which assigns one value
+// less than the results of the function returning an error, to check the
+// error. It reports whether the assignment was fixed.
+func (s *Session) unwrapAssign(pos token.Pos) bool {
+	nodepath, _ := astutil.PathEnclosingInterval(s.file, pos, pos)
+
+	for _, node := range nodepath {
+		assign, ok := node.(*ast.AssignStmt)
+		if !ok || len(assign.Rhs) != 1 {
+			continue
+		}
+		t, ok := s.typeInfo.TypeOf(assign.Rhs[0]).(*types.Tuple)
+		if !ok || !returnsError(t) || t.Len() != len(assign.Lhs)+1 {
+			return false
+		}
+
+		for i, stmt := range s.mainBody.List {
+			if stmt != assign {
+				continue
+			}
+
+			name := s.newErrVarName()
+			stmts := append([]ast.Stmt{}, s.mainBody.List[0:i]...)
+			if assign.Tok != token.DEFINE {
+				stmts = append(stmts, &ast.DeclStmt{
+					Decl: &ast.GenDecl{
+						Tok: token.VAR,
+						Specs: []ast.Spec{
+							&ast.ValueSpec{
+								Names: []*ast.Ident{ast.NewIdent(name)},
+								Type:  ast.NewIdent("error"),
+							},
+						},
+					},
+				})
+			}
+			assign.Lhs = append(assign.Lhs, ast.NewIdent(name))
+			stmts = append(stmts, assign, &ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun:  ast.NewIdent(checkErrName),
+					Args: []ast.Expr{ast.NewIdent(name)},
+				},
+			})
+			s.mainBody.List = append(stmts, s.mainBody.List[i+1:]...)
+			return true
+		}
+		return false
+	}
+
+	return false
+}
+
+// newErrVarName returns a name of a variable for errors
+// which is not used in main.
+func (s *Session) newErrVarName() string {
+	n := 0
+	ast.Inspect(s.mainBody, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && strings.HasPrefix(ident.Name, errVarPrefix) {
+			if i, err := strconv.Atoi(strings.TrimPrefix(ident.Name, errVarPrefix)); err == nil && i >= n {
+				n = i + 1
+			}
+		}
+		return true
+	})
+	return fmt.Sprintf("%s%d", errVarPrefix, n)
+}
+
+// setUnwrap sets the unwrap option by "on" or "off".
+func (s *Session) setUnwrap(arg string) error {
+	switch arg {
+	case "on":
+		s.unwrap = true
+	case "off":
+		s.unwrap = false
+	default:
+		return fmt.Errorf("invalid argument: %s (must be on or off)", arg)
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
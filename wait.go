@@ -0,0 +1,263 @@
+package gore
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Waiting for goroutines
+//
+// The program exits when main returns, so goroutines started by the inputs,
+// like go worker() or the function of time.AfterFunc, usually have no chance
+// to run. With -wait (or :set wait <duration>), main waits at its end for them
+// to finish up to the duration, and then reports those still running with the
+// inputs which started them.
+//
+// The goroutines are tracked by the profiler labels of goroutines: the label
+// of main is set to the number of each input as it runs (see waitLabelName),
+// and goroutines inherit the label of the goroutine starting them. Since the
+// function of time.AfterFunc runs in a new goroutine only when the timer
+// fires, calls to time.AfterFunc are given to afterFuncName, which labels the
+// function and keeps the timer waited until its time has passed. The output
+// written while waiting appears as the output of the latest input.
+//
+// Apart from waiting, a program which dies of "all goroutines are asleep"
+// is reported as a deadlock in the input running then, and the input is
+// dropped.
+
+const (
+	waitLabelName = "__gore_label"
+	waitName      = "__gore_wait"
+	afterFuncName = "__gore_afterFunc"
+)
+
+const waitSource = `package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	__gore_input  string
+	__gore_timers struct {
+		sync.Mutex
+		deadlines map[*time.Timer]time.Time
+	}
+)
+
+func ` + waitLabelName + `(n int) {
+	__gore_input = fmt.Sprint(n)
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("gore_input", __gore_input)))
+}
+
+func ` + afterFuncName + `(afterFunc func(time.Duration, func()) *time.Timer, d time.Duration, f func()) *time.Timer {
+	input := __gore_input
+	var t *time.Timer
+	__gore_timers.Lock()
+	defer __gore_timers.Unlock()
+	t = afterFunc(d, func() {
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("gore_input", input)))
+		__gore_timers.Lock()
+		delete(__gore_timers.deadlines, t)
+		__gore_timers.Unlock()
+		f()
+	})
+	if __gore_timers.deadlines == nil {
+		__gore_timers.deadlines = map[*time.Timer]time.Time{}
+	}
+	// a stopped timer is no longer waited after the time
+	__gore_timers.deadlines[t] = time.Now().Add(d)
+	return t
+}
+
+// __gore_running returns the goroutines started by the inputs other than
+// the current one, by the inputs and the functions starting them.
+func __gore_running() (running []string) {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	for _, record := range strings.Split(buf.String(), "\n\n") {
+		const label = "# labels: {\"gore_input\":\""
+		i := strings.Index(record, label)
+		if i < 0 || strings.Contains(record, ".` + waitName + `+") {
+			continue
+		}
+		// records not in the expected format are skipped
+		input := record[i+len(label):]
+		end := strings.IndexByte(input, '"')
+		if end < 0 {
+			continue
+		}
+		input = input[:end]
+
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		frame := strings.Fields(lines[len(lines)-1])
+		if len(frame) < 2 {
+			continue
+		}
+		entry := frame[len(frame)-2]
+		end = strings.LastIndex(entry, "+")
+		if end < 0 {
+			continue
+		}
+		entry = entry[:end]
+
+		var count int
+		fmt.Sscan(record, &count)
+		r := fmt.Sprintf("#%s %s", input, entry)
+		if count > 1 {
+			r += fmt.Sprintf(" (%d goroutines)", count)
+		}
+		running = append(running, r)
+	}
+	return
+}
+
+func __gore_pending(now time.Time) bool {
+	__gore_timers.Lock()
+	defer __gore_timers.Unlock()
+	for _, deadline := range __gore_timers.deadlines {
+		if now.Before(deadline.Add(10 * time.Millisecond)) {
+			return true
+		}
+	}
+	return false
+}
+
+func ` + waitName + `(grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for {
+		running := __gore_running()
+		now := time.Now()
+		if len(running) == 0 && !__gore_pending(now) {
+			return
+		}
+		if now.After(deadline) {
+			if len(running) > 0 {
+				fmt.Fprintf(os.Stderr, "gore: goroutines still running after %s:\n", grace)
+				for _, r := range running {
+					fmt.Fprintf(os.Stderr, "    %s\n", r)
+				}
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+`
+
+// setWait sets the duration to wait for goroutines by a duration or "off".
+func (s *Session) setWait(arg string) error {
+	if arg == "off" {
+		s.wait = 0
+		return nil
+	}
+
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid duration: %s", arg)
+	}
+	s.wait = d
+
+	return nil
+}
+
+func (s *Session) waitString() string {
+	if s.wait <= 0 {
+		return "off"
+	}
+	return s.wait.String()
+}
+
+// prepareWait modifies the session file for a run waiting for goroutines:
+// main labels itself after every marker and waits at its end, and calls to
+// time.AfterFunc are tracked. It returns a function to undo the changes.
+func (s *Session) prepareWait() (undo func()) {
+	if s.wait <= 0 {
+		return func() {}
+	}
+
+	stmts := s.mainBody.List
+	body := make([]ast.Stmt, 0, 2*len(stmts)+1)
+	for _, stmt := range stmts {
+		body = append(body, stmt)
+		if n, ok := markerNo(stmt); ok {
+			body = append(body, &ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun:  ast.NewIdent(waitLabelName),
+					Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}},
+				},
+			})
+		}
+	}
+	body = append(body, &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun:  ast.NewIdent(waitName),
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(int64(s.wait), 10)}},
+		},
+	})
+
+	info := types.Info{Uses: map[*ast.Ident]types.Object{}}
+	conf := *s.types
+	conf.Error = func(err error) {}
+	conf.Check("main", s.fset, append(s.checkFiles(), s.file), &info)
+
+	type call struct {
+		call *ast.CallExpr
+		fun  ast.Expr
+		args []ast.Expr
+	}
+	var calls []call
+	ast.Inspect(s.file, func(n ast.Node) bool {
+		c, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := c.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "AfterFunc" {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); ok {
+			if pkg, ok := info.Uses[x].(*types.PkgName); ok && pkg.Imported().Path() == "time" {
+				calls = append(calls, call{c, c.Fun, c.Args})
+			}
+		}
+		return true
+	})
+	for _, c := range calls {
+		c.call.Fun = ast.NewIdent(afterFuncName)
+		c.call.Args = append([]ast.Expr{c.fun}, c.args...)
+	}
+
+	s.mainBody.List = body
+
+	return func() {
+		s.mainBody.List = stmts
+		for _, c := range calls {
+			c.call.Fun, c.call.Args = c.fun, c.args
+		}
+	}
+}
+
+var deadlockMessage = []byte("fatal error: all goroutines are asleep - deadlock!")
+
+// isDeadlock reports whether the program died of a deadlock
+// from its error output.
+func isDeadlock(stderr []byte) bool {
+	return bytes.Contains(stderr, deadlockMessage)
+}